@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/sdl2"
+	"log"
+	"math"
+	"math/rand"
+)
+
+const sampleRate = 22050
+
+// Sound is a mono clip, with samples from -1 to 1.
+type Sound struct {
+	samples []float32
+	volume  float32
+}
+
+var footstepSound = synthesize(0.08, 0.4, func(t float64) float64 {
+	return (rand.Float64()*2 - 1) * math.Exp(-t*60)
+})
+
+var tagSound = synthesize(0.3, 1, func(t float64) float64 {
+	frequency := 440.0
+	if t > 0.1 {
+		frequency = 660
+	}
+	return math.Copysign(0.5, math.Sin(2*math.Pi*frequency*t)) * math.Exp(-t*8)
+})
+
+var doorSound = synthesize(0.25, 0.7, func(t float64) float64 {
+	thud := math.Sin(2*math.Pi*90*t) * math.Exp(-t*20)
+	creak := math.Sin(2*math.Pi*(300+200*t)*t) * 0.3 * math.Exp(-t*10)
+	return thud + creak
+})
+
+func synthesize(seconds float64, volume float32, wave func(t float64) float64) *Sound {
+	samples := make([]float32, int(seconds*sampleRate))
+	for i := range samples {
+		samples[i] = float32(wave(float64(i) / sampleRate))
+	}
+	return &Sound{samples, volume}
+}
+
+// Sounds fade out completely this many tiles away
+const hearingRange = 24
+
+// Sounds this many tiles to the side are fully in one ear
+const panRange = 12
+
+// Every wall tile between a sound and the listener halves its volume and
+// cutoff frequency, and past the last it can't be heard at all.
+const occlusionGain = 0.5
+const maxOcclusion = 5
+const unoccludedCutoff = 4000
+
+// The device is kept this many ticks of sound ahead.
+const queuedTicks = 4
+const tickSamples = sampleRate / common.TickRate
+
+// Audio mixes sounds placed around the listener into an SDL audio device.
+// A nil Audio plays nothing.
+type Audio struct {
+	device *sdl.AudioDevice
+	volume float32
+	voices []*voice
+	mix    []int16
+}
+
+type voice struct {
+	sound  *Sound
+	offset int
+	gain   [2]float32
+	// Of the one pole low pass filter, 1 leaving the sound untouched
+	smoothing float32
+	filtered  float32
+}
+
+func openAudio(volume float32) *Audio {
+	if volume <= 0 {
+		return nil
+	}
+	device, err := sdl.OpenAudioDevice(sampleRate, 2, tickSamples)
+	if err != nil {
+		log.Println("No sound:", err)
+		return nil
+	}
+	device.Pause(false)
+	return &Audio{device: device, volume: volume}
+}
+
+func (audio *Audio) close() {
+	if audio == nil {
+		return
+	}
+	audio.device.Close()
+}
+
+// play starts sound offset away from the listener, muffled by walls solid
+// tiles in between.
+func (audio *Audio) play(sound *Sound, offset [2]float32, walls int) {
+	if audio == nil || walls > maxOcclusion {
+		return
+	}
+	distance := math.Hypot(float64(offset[0]), float64(offset[1]))
+	gain := float64(sound.volume) * (1 - distance/hearingRange) * math.Pow(occlusionGain, float64(walls))
+	if gain <= 0 {
+		return
+	}
+	pan := math.Max(-1, math.Min(1, float64(offset[0])/panRange))
+
+	smoothing := float32(1)
+	if walls > 0 {
+		cutoff := unoccludedCutoff * math.Pow(occlusionGain, float64(walls))
+		smoothing = float32(1 - math.Exp(-2*math.Pi*cutoff/sampleRate))
+	}
+	audio.voices = append(audio.voices, &voice{
+		sound: sound,
+		gain: [2]float32{
+			float32(gain * math.Sqrt((1-pan)/2)),
+			float32(gain * math.Sqrt((1+pan)/2)),
+		},
+		smoothing: smoothing,
+	})
+}
+
+// update mixes the playing sounds into the device until it is far enough
+// ahead.
+func (audio *Audio) update() {
+	if audio == nil {
+		return
+	}
+	for audio.device.Queued() < queuedTicks*tickSamples*2 {
+		audio.mixTick()
+		err := audio.device.Queue(audio.mix)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
+
+func (audio *Audio) mixTick() {
+	audio.mix = audio.mix[:0]
+	for i := 0; i < tickSamples; i++ {
+		var frame [2]float32
+		for _, v := range audio.voices {
+			if v.offset >= len(v.sound.samples) {
+				continue
+			}
+			v.filtered += v.smoothing * (v.sound.samples[v.offset] - v.filtered)
+			v.offset++
+			frame[0] += v.filtered * v.gain[0]
+			frame[1] += v.filtered * v.gain[1]
+		}
+		for _, sample := range frame {
+			sample = float32(math.Max(-1, math.Min(1, float64(sample*audio.volume))))
+			audio.mix = append(audio.mix, int16(sample*math.MaxInt16))
+		}
+	}
+
+	playing := audio.voices[:0]
+	for _, v := range audio.voices {
+		if v.offset < len(v.sound.samples) {
+			playing = append(playing, v)
+		}
+	}
+	audio.voices = playing
+}
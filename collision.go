@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+)
+
+const playerRadius = 0.5
+
+// Movement is split into steps no longer than this so a circle can never
+// pass through a one tile thick wall, whatever the speed.
+const maxCollisionStep = playerRadius / 2
+
+// moveCircle moves a circle centered at position by delta, sliding along
+// any solid tiles it runs into, and returns the new center.
+func moveCircle(scene *Scene, position, delta [2]float32, radius float32) [2]float32 {
+	length := math.Hypot(float64(delta[0]), float64(delta[1]))
+	steps := int(math.Ceil(length / maxCollisionStep))
+	for i := 0; i < steps; i++ {
+		position[0] += delta[0] / float32(steps)
+		position[1] += delta[1] / float32(steps)
+		position = resolveCircle(scene, position, radius)
+	}
+	return position
+}
+
+// resolveCircle pushes a circle out of any solid tiles it overlaps. Tiles
+// are unit squares centered on integer coordinates. The deepest overlap is
+// resolved first, so a circle against a flat wall is pushed straight out of
+// it rather than off the corners where its tiles meet.
+func resolveCircle(scene *Scene, position [2]float32, radius float32) [2]float32 {
+	for iteration := 0; iteration < 8; iteration++ {
+		minX := int(math.Floor(float64(position[0] - radius + 0.5)))
+		maxX := int(math.Floor(float64(position[0] + radius + 0.5)))
+		minY := int(math.Floor(float64(position[1] - radius + 0.5)))
+		maxY := int(math.Floor(float64(position[1] + radius + 0.5)))
+		var deepest [2]float32
+		var deepestSq float32
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				if !scene.getWall(x, y).Solid() {
+					continue
+				}
+				push, hit := circleTilePush(position, radius, x, y)
+				if pushSq := push[0]*push[0] + push[1]*push[1]; hit && pushSq > deepestSq {
+					deepest, deepestSq = push, pushSq
+				}
+			}
+		}
+		if deepestSq == 0 {
+			break
+		}
+		position[0] += deepest[0]
+		position[1] += deepest[1]
+	}
+	return position
+}
+
+// circleTilePush returns the smallest offset that moves the circle out of
+// the tile at x, y, and whether the two overlap at all.
+func circleTilePush(position [2]float32, radius float32, x, y int) ([2]float32, bool) {
+	closestX := clamp(position[0], float32(x)-0.5, float32(x)+0.5)
+	closestY := clamp(position[1], float32(y)-0.5, float32(y)+0.5)
+	diffX := position[0] - closestX
+	diffY := position[1] - closestY
+	distSq := diffX*diffX + diffY*diffY
+	if distSq >= radius*radius {
+		return [2]float32{}, false
+	}
+
+	if distSq > 0 {
+		dist := float32(math.Sqrt(float64(distSq)))
+		return [2]float32{
+			diffX / dist * (radius - dist),
+			diffY / dist * (radius - dist),
+		}, true
+	}
+
+	// The center is inside the tile, so push out along the shallowest axis
+	offsetX := position[0] - float32(x)
+	offsetY := position[1] - float32(y)
+	if abs(offsetX) > abs(offsetY) {
+		return [2]float32{sign(offsetX)*(0.5+radius) - offsetX, 0}, true
+	}
+	return [2]float32{0, sign(offsetY)*(0.5+radius) - offsetY}, true
+}
+
+func clamp(value, min, max float32) float32 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func abs(value float32) float32 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func sign(value float32) float32 {
+	if value < 0 {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"testing"
+)
+
+const room = `
+1111111111
+1000000001
+1000000001
+1000000001
+1000000001
+1000000001
+1111111111
+`
+
+// A room split down the middle by a one tile thick wall
+const thinWall = `
+1111111111
+1000010001
+1000010001
+1000010001
+1111111111
+`
+
+const corridor = `
+11111111111
+10000000001
+11111111111
+`
+
+// A room with a one tile wide corridor leading down out of it
+const sideCorridor = `
+1111111111
+1000000001
+1000000001
+1111011111
+1111011111
+1111011111
+1111111111
+`
+
+// The fastest speed in the server's speedMap, for invincible players
+const fastestSpeed = 0.3
+
+func TestMoveCircle(t *testing.T) {
+	cases := []struct {
+		name  string
+		world string
+		start [2]float32
+		delta [2]float32
+		ticks int
+		want  [2]float32
+	}{
+		{"open", room, [2]float32{2, 2}, [2]float32{0.1, 0}, 10, [2]float32{3, 2}},
+		{"fastest speed", room, [2]float32{1, 2}, [2]float32{fastestSpeed, 0}, 5, [2]float32{2.5, 2}},
+		{"fastest speed into wall", room, [2]float32{1, 2}, [2]float32{fastestSpeed, 0}, 40, [2]float32{8, 2}},
+		{"one and a half tiles per tick", thinWall, [2]float32{2, 2}, [2]float32{1.5, 0}, 10, [2]float32{4, 2}},
+		{"three tiles per tick", thinWall, [2]float32{1, 2}, [2]float32{3, 0}, 10, [2]float32{4, 2}},
+		{"three tiles per tick back", thinWall, [2]float32{8, 2}, [2]float32{-3, 0}, 10, [2]float32{6, 2}},
+		{"slide along wall", room, [2]float32{7, 2}, [2]float32{0.2, 0.2}, 10, [2]float32{8, 4}},
+		{"slide along ceiling", room, [2]float32{2, 2}, [2]float32{0.2, -0.2}, 10, [2]float32{4, 1}},
+		{"corner", room, [2]float32{7, 4}, [2]float32{0.3, 0.3}, 20, [2]float32{8, 5}},
+		{"corridor", corridor, [2]float32{1, 1}, [2]float32{0.3, 0}, 40, [2]float32{9, 1}},
+		{"corridor diagonal", corridor, [2]float32{1, 1}, [2]float32{0.2, 0.2}, 10, [2]float32{3, 1}},
+		{"into side corridor", sideCorridor, [2]float32{4, 1}, [2]float32{0, 0.3}, 20, [2]float32{4, 5}},
+		{"into side corridor off center", sideCorridor, [2]float32{4.2, 1}, [2]float32{0, 0.3}, 40, [2]float32{4, 5}},
+	}
+	for _, c := range cases {
+		scene := testScene(t, c.world)
+		position := c.start
+		for i := 0; i < c.ticks; i++ {
+			position = moveCircle(scene, position, c.delta, playerRadius)
+		}
+		if !near(position, c.want) {
+			t.Errorf("%s: ended at %v, expected %v", c.name, position, c.want)
+		}
+	}
+}
+
+// Pushing into a corner or a wall leaves the player still, rather than
+// jittering between positions.
+func TestMoveCircleNoJitter(t *testing.T) {
+	cases := []struct {
+		name  string
+		world string
+		start [2]float32
+		delta [2]float32
+	}{
+		{"corner", room, [2]float32{8, 5}, [2]float32{0.3, 0.3}},
+		{"corner steep", room, [2]float32{8, 5}, [2]float32{0.05, 0.3}},
+		{"wall", thinWall, [2]float32{4, 2}, [2]float32{0.3, 0}},
+		{"corridor end", corridor, [2]float32{9, 1}, [2]float32{0.3, -0.1}},
+		{"fast corner", room, [2]float32{8, 5}, [2]float32{2, 2}},
+	}
+	for _, c := range cases {
+		scene := testScene(t, c.world)
+		for i := 0; i < 10; i++ {
+			if position := moveCircle(scene, c.start, c.delta, playerRadius); !near(position, c.start) {
+				t.Errorf("%s: moved from %v to %v", c.name, c.start, position)
+				break
+			}
+		}
+	}
+}
+
+func TestCircleTilePush(t *testing.T) {
+	cases := []struct {
+		name     string
+		position [2]float32
+		want     [2]float32
+		hit      bool
+	}{
+		{"apart", [2]float32{2, 0}, [2]float32{}, false},
+		{"touching", [2]float32{1, 0}, [2]float32{}, false},
+		{"side", [2]float32{0.8, 0}, [2]float32{0.2, 0}, true},
+		{"above", [2]float32{0, -0.9}, [2]float32{0, -0.1}, true},
+		{"corner", [2]float32{0.8, 0.8}, [2]float32{0.0535534, 0.0535534}, true},
+		{"center inside", [2]float32{0.3, 0.1}, [2]float32{0.7, 0}, true},
+	}
+	for _, c := range cases {
+		push, hit := circleTilePush(c.position, playerRadius, 0, 0)
+		if hit != c.hit || !near(push, c.want) {
+			t.Errorf("%s: pushed by %v, %v, expected %v, %v", c.name, push, hit, c.want, c.hit)
+		}
+	}
+}
+
+func testScene(t *testing.T, world string) *Scene {
+	m, err := common.ParseMap(world)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newScene(m)
+}
+
+func near(a, b [2]float32) bool {
+	return abs(a[0]-b[0]) < 0.001 && abs(a[1]-b[1]) < 0.001
+}
@@ -1,15 +1,475 @@
 package common
 
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// TickRate is the number of simulation ticks per second, shared by the
+// client and server.
+const TickRate = 60
+
 type Player struct {
+	Id       int
 	Position [2]float32
+	Facing   [2]float32
+	State    PlayerState
 	Color    [3]float32
+	// Teammates share what they see
+	Team int
 }
 
+type PlayerState int
+
+const (
+	PlayerRun PlayerState = iota
+	PlayerIt
+	PlayerInvincible
+	// A thief caught by a guard, out until the next heist round
+	PlayerCaught
+)
+
 type ServerState struct {
-	Players []Player
-	Speed   float32
+	// The receiving player's own id
+	Id          int
+	Players     []Player
+	Speed       float32
+	TileChanges []TileChange
+	Vision      Vision
+	// Ticks left until the receiving player stops being invincible
+	InvincibleTime int
+	Scoreboard     []Score
+	// The Time of the last ClientState received, for measuring ping
+	Echo int64
+	// What happened since the last ServerState that the player could see
+	Events []Event
+	// The receiving player's stamina, as the server has it
+	Stamina Stamina
+	// Where the server put the player back to, when it refused a move that
+	// was too fast
+	Correction *[2]float32
+	Round      Round
+	// The heist being played in the heist mode, or nil in the tag mode
+	Heist *Heist
+}
+
+// Round is where the game is in its cycle of rounds.
+type Round struct {
+	Phase Phase
+	// Ticks until the phase ends, or 0 while waiting
+	TimeLeft int
+	// Counting from 1, the round being played or the last one
+	Number int
+	// How the last round ended, such as who won
+	Result string
+}
+
+type Phase int
+
+const (
+	// Not enough players have joined to start a round
+	PhaseWaiting Phase = iota
+	// Everyone has been put at a spawn point and waits for the round to start
+	PhaseCountdown
+	PhasePlay
+	// The round is over and its results are shown
+	PhaseResults
+)
+
+// Heist is how a heist round is going. Thieves win by escaping through an
+// exit with Required loot, and guards win by catching every thief or
+// running the clock down.
+type Heist struct {
+	// The loot still lying where it started
+	Loot              [][2]int
+	Escaped, Required int
+	// How much loot the receiving player is carrying
+	Carrying int
+	// Rounds won by each team
+	Wins [2]int
+}
+
+// Teams in the heist mode
+const (
+	TeamThieves = iota
+	TeamGuards
+)
+
+var TeamNames = map[int]string{
+	TeamThieves: "Thieves",
+	TeamGuards:  "Guards",
+}
+
+// Event is something that happened on the server for clients to show.
+type Event struct {
+	Kind EventKind
+	// Who caused it, or -1 when that is a secret, and who it happened to
+	Player, Target int
+	Position       [2]float32
+	// How far a noise carried
+	Radius float32
+}
+
+type EventKind int
+
+const (
+	EventTag EventKind = iota
+	// Target heard someone moving around Position, only roughly placed so
+	// it can't be used to see through walls
+	EventNoise
+)
+
+// Score is one line of the scoreboard, for every connected player.
+type Score struct {
+	Id    int
+	Name  string
+	State PlayerState
+	Team  int
+	// This round, how many players they have tagged, how much loot they
+	// escaped with, and how many times they were tagged themselves
+	Tags, Loot, Tagged int
+}
+
+// Hello is sent by the client once when connecting, before any
+// ClientState.
+type Hello struct {
+	Name string
 }
 
 type ClientState struct {
 	Position [2]float32
+	Facing   [2]float32
+	Interact bool
+	// Whether the player wants to sprint, which the server only allows with
+	// stamina left
+	Sprint bool
+	// When the client sent this, in its own clock's nanoseconds
+	Time int64
+}
+
+// Stamina is how many more ticks a player can sprint for. It is worked out
+// the same way by the server, which enforces it, and by the client, which
+// predicts it.
+type Stamina struct {
+	Left      float32
+	Sprinting bool
+}
+
+// Sprinting multiplies a player's speed by this much
+const SprintMultiplier = 1.6
+const MaxStamina = 3 * TickRate
+
+// Stamina comes back this much every tick not spent sprinting
+const StaminaRegen = 0.5
+
+// After running out, sprinting only starts again with this much stamina
+const SprintRecovery = TickRate / 2
+
+func FullStamina() Stamina {
+	return Stamina{Left: MaxStamina}
+}
+
+// CanSprint reports whether a player who wants to sprint is able to.
+func (stamina Stamina) CanSprint(want bool) bool {
+	if stamina.Sprinting {
+		return want && stamina.Left >= 1
+	}
+	return want && stamina.Left >= SprintRecovery
+}
+
+// Update spends a tick of stamina if the player sprinted, and otherwise
+// lets it regenerate.
+func (stamina *Stamina) Update(sprinted bool) {
+	stamina.Sprinting = sprinted
+	if sprinted {
+		stamina.Left--
+		return
+	}
+	stamina.Left += StaminaRegen
+	if stamina.Left > MaxStamina {
+		stamina.Left = MaxStamina
+	}
+}
+
+// Light is a light source, shining Radius tiles within Fov radians of
+// Facing and Glow tiles in every direction. Lights are blocked by walls and
+// fade linearly to nothing at their radius.
+type Light struct {
+	Position [2]float32
+	Facing   [2]float32
+	Radius   float32
+	Fov      float32
+	Glow     float32
+}
+
+// Anything lit less than this is too dark to see.
+const LitThreshold = 0.1
+
+func LampLight(x, y int) Light {
+	return Light{[2]float32{float32(x), float32(y)}, [2]float32{1, 0}, 7, 2 * math.Pi, 0}
+}
+
+func PlayerLight(position, facing [2]float32) Light {
+	return Light{position, facing, 12, 0.9, 1.5}
+}
+
+// Intensity returns how brightly the light lights point.
+func (light Light) Intensity(m *Map, point [2]float32) float32 {
+	diffX := float64(point[0] - light.Position[0])
+	diffY := float64(point[1] - light.Position[1])
+	dist := math.Hypot(diffX, diffY)
+	if dist >= float64(light.Radius) {
+		return 0
+	}
+	if dist > float64(light.Glow) && light.Fov < 2*math.Pi {
+		cos := (diffX*float64(light.Facing[0]) + diffY*float64(light.Facing[1])) / dist
+		if cos < math.Cos(float64(light.Fov)/2) {
+			return 0
+		}
+	}
+	if !m.CanSee(light.Position, point) {
+		return 0
+	}
+	return 1 - float32(dist)/light.Radius
+}
+
+// Lit returns the total light falling on point, up to 1.
+func Lit(m *Map, lights []Light, point [2]float32) float32 {
+	var total float32
+	for _, light := range lights {
+		total += light.Intensity(m, point)
+		if total >= 1 {
+			return 1
+		}
+	}
+	return total
+}
+
+// Vision describes what a player can see: everything within Fov radians of
+// their facing direction, plus everything within Peripheral tiles of them.
+type Vision struct {
+	Fov        float32
+	Peripheral float32
+}
+
+var DefaultVision = Vision{Fov: 1.9198622, Peripheral: 2.5}
+
+// InView reports whether target is inside the vision cone of a viewer at
+// position facing the unit vector facing, ignoring walls.
+func (vision Vision) InView(position, facing, target [2]float32) bool {
+	diffX := float64(target[0] - position[0])
+	diffY := float64(target[1] - position[1])
+	dist := math.Hypot(diffX, diffY)
+	if dist <= float64(vision.Peripheral) {
+		return true
+	}
+	cos := (diffX*float64(facing[0]) + diffY*float64(facing[1])) / dist
+	return cos >= math.Cos(float64(vision.Fov)/2)
+}
+
+// Viewer is someone looking out from Position towards Facing.
+type Viewer struct {
+	Position [2]float32
+	Facing   [2]float32
+}
+
+// Sees reports whether any of viewers can see target, ignoring light.
+func (vision Vision) Sees(m *Map, viewers []Viewer, target [2]float32) bool {
+	for _, viewer := range viewers {
+		if vision.InView(viewer.Position, viewer.Facing, target) && m.CanSee(viewer.Position, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type TileChange struct {
+	X, Y int
+	Wall Wall
+}
+
+type Wall int
+
+const (
+	WallNone Wall = iota
+	WallStone
+	WallDoor
+	WallDoorOpen
+	WallCrate
+)
+
+// Solid reports whether the tile blocks both movement and line of sight.
+func (wall Wall) Solid() bool {
+	return wall != WallNone && wall != WallDoorOpen
+}
+
+type Map struct {
+	Width, Height int
+	Walls         []Wall
+	Lamps         [][2]int
+	// Where the loot starts, and where thieves escape with it, in the heist
+	// mode
+	Loot  [][2]int
+	Exits [][2]int
+	// Where players may be put at the start of a round
+	Spawns [][2]int
+}
+
+func NewMap(width, height int) *Map {
+	return &Map{width, height, make([]Wall, width*height), make([][2]int, 0), make([][2]int, 0), make([][2]int, 0), make([][2]int, 0)}
+}
+
+// Copy returns a map with the same tiles and markers, to change without
+// changing m.
+func (m *Map) Copy() *Map {
+	c := NewMap(m.Width, m.Height)
+	copy(c.Walls, m.Walls)
+	c.Lamps = append(c.Lamps, m.Lamps...)
+	c.Loot = append(c.Loot, m.Loot...)
+	c.Exits = append(c.Exits, m.Exits...)
+	c.Spawns = append(c.Spawns, m.Spawns...)
+	return c
+}
+
+// LoadMap reads a map where each line is a row of tile digits. Open floor
+// may instead hold a marker: * for a lamp, $ for loot, E for an exit, or S
+// for a spawn point. The first line of the file is the top row of the map.
+func LoadMap(filename string) (*Map, error) {
+	mapBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMap(string(mapBytes))
+}
+
+func ParseMap(mapString string) (*Map, error) {
+	lines := make([]string, 0)
+	width := 0
+	for _, line := range strings.Split(mapString, "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(line) > width {
+			width = len(line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("Empty map")
+	}
+
+	m := NewMap(width, len(lines))
+	for j, line := range lines {
+		y := m.Height - 1 - j
+		for i := 0; i < width; i++ {
+			if i >= len(line) {
+				m.Set(i, y, WallStone)
+				continue
+			}
+			switch {
+			case line[i] >= '0' && line[i] <= '9':
+				m.Set(i, y, Wall(line[i]-'0'))
+			case line[i] == '*':
+				m.Lamps = append(m.Lamps, [2]int{i, y})
+			case line[i] == '$':
+				m.Loot = append(m.Loot, [2]int{i, y})
+			case line[i] == 'E':
+				m.Exits = append(m.Exits, [2]int{i, y})
+			case line[i] == 'S':
+				m.Spawns = append(m.Spawns, [2]int{i, y})
+			default:
+				return nil, errors.New("Unknown map tile: " + string(line[i]))
+			}
+		}
+	}
+	return m, nil
+}
+
+// Contains reports whether x, y is a tile of the map.
+func (m *Map) Contains(x, y int) bool {
+	return x >= 0 && y >= 0 && x < m.Width && y < m.Height
+}
+
+func (m *Map) Get(x, y int) Wall {
+	if !m.Contains(x, y) {
+		return WallStone
+	}
+	return m.Walls[x+y*m.Width]
+}
+
+func (m *Map) Set(x, y int, wall Wall) {
+	m.Walls[x+y*m.Width] = wall
+}
+
+// CanSee reports whether the segment between from and to crosses no solid
+// tiles, walking every tile the segment touches.
+func (m *Map) CanSee(from, to [2]float32) bool {
+	visible := true
+	walkSegment(from, to, func(x, y int) bool {
+		visible = !m.Get(x, y).Solid()
+		return visible
+	})
+	return visible
+}
+
+// SolidBetween counts the solid tiles the segment between from and to
+// touches, for how muffled a sound is on its way through walls.
+func (m *Map) SolidBetween(from, to [2]float32) int {
+	count := 0
+	walkSegment(from, to, func(x, y int) bool {
+		if m.Get(x, y).Solid() {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// walkSegment calls visit with every tile the segment between from and to
+// touches, in order, until visit returns false.
+func walkSegment(from, to [2]float32, visit func(x, y int) bool) {
+	x0, y0 := float64(from[0])+0.5, float64(from[1])+0.5
+	x1, y1 := float64(to[0])+0.5, float64(to[1])+0.5
+	tileX, tileY := int(math.Floor(x0)), int(math.Floor(y0))
+	endX, endY := int(math.Floor(x1)), int(math.Floor(y1))
+
+	stepX, tDeltaX, tMaxX := gridStep(x0, x1)
+	stepY, tDeltaY, tMaxY := gridStep(y0, y1)
+
+	n := 1 + abs(endX-tileX) + abs(endY-tileY)
+	for ; n > 0; n-- {
+		if !visit(tileX, tileY) {
+			return
+		}
+		if tMaxX < tMaxY {
+			tMaxX += tDeltaX
+			tileX += stepX
+		} else {
+			tMaxY += tDeltaY
+			tileY += stepY
+		}
+	}
+}
+
+// gridStep returns the direction along one axis, how far along the segment
+// it takes to cross a whole tile, and how far to cross the first boundary.
+func gridStep(from, to float64) (int, float64, float64) {
+	diff := to - from
+	if diff > 0 {
+		return 1, 1 / diff, (math.Floor(from) + 1 - from) / diff
+	}
+	if diff < 0 {
+		return -1, -1 / diff, (from - math.Floor(from)) / -diff
+	}
+	return 0, math.Inf(1), math.Inf(1)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
 }
@@ -2,23 +2,93 @@ package main
 
 import (
 	"errors"
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/line-of-sight/raster"
 	"github.com/go-gl/gl"
+	"image"
 	"log"
+	"math"
 )
 
+// Renderer draws a scene. Draw renders with OpenGL, and SoftwareRenderer
+// renders in pure Go.
+type Renderer interface {
+	// Textures tiles and sprites, or draws them procedurally when nil. Must
+	// be set before generateWalls.
+	setAtlas(atlas *raster.Atlas)
+	generateWalls(scene *Scene)
+	draw(scene *Scene, ops *OutputState)
+	renderImage(scene *Scene, ops *OutputState) *image.RGBA
+
+	// For entities to draw themselves with
+	interpolation() float32
+	sprite(position [2]float32, state common.PlayerState, color [3]float32)
+	ghost(position [2]float32, state common.PlayerState, color [3]float32, alpha float32)
+	// Draws text with its top left corner at position, in screen pixels
+	// from the top left
+	text(position [2]float32, text string, color [3]float32)
+	toScreen(position [2]float32) [2]float32
+	minimapDot(position [2]float32, color [3]float32)
+	// Draws a rectangle size tiles across, hidden out of sight like sprites
+	// unless ignoreLos is set
+	effect(position, size [2]float32, color [3]float32, alpha float32, ignoreLos bool)
+}
+
 type Draw struct {
 	screenWidth,
 	screenHeight int
 	simpleQuad       gl.Buffer
+	simpleQuadVAO    gl.VertexArray
 	walls            gl.Buffer
+	wallsVAO         gl.VertexArray
 	wallLength       int
+	wallTiles        gl.Buffer
+	wallTilesVAO     gl.VertexArray
+	wallTileLength   int
 	simpleShader     gl.Program
 	losBlockerShader gl.Program
 	LOSfb            gl.Framebuffer
 	LOStex           gl.Texture
+	blurFb           gl.Framebuffer
+	blurTex          gl.Texture
+	blurShader       gl.Program
+	blurVAO          gl.VertexArray
+	copyShader       gl.Program
+	copyVAO          gl.VertexArray
+	soft             bool
+	exploredFb       gl.Framebuffer
+	exploredTex      gl.Texture
+	exploredShader   gl.Program
+	exploredVAO      gl.VertexArray
+	mapSize          [2]float32
+	target           gl.Framebuffer
+	imageFb          gl.Framebuffer
+	imageTex         gl.Texture
 	backgroundShader gl.Program
-	backgroundQuad   gl.Buffer
+	backgroundVAO    gl.VertexArray
 	wallShader       gl.Program
+	screenQuad       gl.Buffer
+	visionShader     gl.Program
+	visionVAO        gl.VertexArray
+	lightFb          gl.Framebuffer
+	lightTex         gl.Texture
+	lightShadowFb    gl.Framebuffer
+	lightShadowTex   gl.Texture
+	lightShader      gl.Program
+	lightVAO         gl.VertexArray
+	atlas            *raster.Atlas
+	atlasTex         gl.Texture
+	fontTex          gl.Texture
+	textBuffer       gl.Buffer
+	textShader       gl.Program
+	textVAO          gl.VertexArray
+	minimapTiles     gl.Texture
+	minimapShader    gl.Program
+	minimapVAO       gl.VertexArray
+	minimapFog       bool
+	dots             []minimapDot
+	camera           matrix
+	alpha            float32
 }
 
 func SetupOpengl(screenWidth, screenHeight int) (*Draw, error) {
@@ -27,91 +97,118 @@ func SetupOpengl(screenWidth, screenHeight int) (*Draw, error) {
 	draw.screenWidth = screenWidth
 	gl.Init()
 
-	gl.Viewport(0, 0, screenWidth, screenHeight)
 	draw.createLosBuffer()
+	draw.resize(screenWidth, screenHeight)
 
-	buffers := make([]gl.Buffer, 3)
+	buffers := make([]gl.Buffer, 5)
 	gl.GenBuffers(buffers)
 
 	draw.simpleQuad = buffers[0]
 	draw.walls = buffers[1]
-	draw.backgroundQuad = buffers[2]
+	draw.screenQuad = buffers[2]
+	draw.wallTiles = buffers[3]
+	draw.textBuffer = buffers[4]
 
 	draw.simpleQuad.Bind(gl.ARRAY_BUFFER)
-	gl.BufferData(gl.ARRAY_BUFFER, 8*2*4*1, //bytes * per vertex * per quad * quads
-		[]float32{
+	gl.BufferData(gl.ARRAY_BUFFER, 4*2*6*1, //bytes * per vertex * per quad * quads
+		quadTriangles([]float32{
 			-0.5, -0.5,
 			0.5, -0.5,
 			0.5, 0.5,
 			-0.5, 0.5,
-		}, gl.STATIC_DRAW)
+		}, 2), gl.STATIC_DRAW)
 	draw.simpleQuad.Unbind(gl.ARRAY_BUFFER)
 
-	draw.backgroundQuad.Bind(gl.ARRAY_BUFFER)
-	gl.BufferData(gl.ARRAY_BUFFER, 8*2*4*1, //bytes * per vertex * per quad * quads
-		[]float32{
-			-50, -50,
-			100, -50,
-			100, 100,
-			-50, 100,
-		}, gl.STATIC_DRAW)
-	draw.backgroundQuad.Unbind(gl.ARRAY_BUFFER)
+	draw.screenQuad.Bind(gl.ARRAY_BUFFER)
+	gl.BufferData(gl.ARRAY_BUFFER, 4*2*6*1, //bytes * per vertex * per quad * quads
+		quadTriangles([]float32{
+			-1, -1,
+			1, -1,
+			1, 1,
+			-1, 1,
+		}, 2), gl.STATIC_DRAW)
+	draw.screenQuad.Unbind(gl.ARRAY_BUFFER)
 
-	vs := compileShader(gl.VERTEX_SHADER, `
-		#version 150 compatibility
+	draw.simpleShader = createProgram(`
+		#version 150
 
 		in vec2 position;
 
 		out vec2 screenPos;
+		out vec2 local;
+
+		uniform mat4 camera;
+		uniform mat4 model;
 
 		void main()
 		{
-		    gl_Position = gl_ProjectionMatrix * gl_ModelViewMatrix * vec4(position, 0.0, 1.0);
+		    gl_Position = camera * model * vec4(position, 0.0, 1.0);
 		    screenPos = gl_Position.xy;
+		    local = position + vec2(0.5, 0.5);
 		}
-		`)
-
-	fs := compileShader(gl.FRAGMENT_SHADER, `
+		`, `
 		#version 150
 
-	uniform sampler2D los;
+		uniform sampler2D los;
+		uniform sampler2D lighting;
+		uniform float litThreshold;
+		uniform bool soft;
+		uniform bool ignoreLos;
 		uniform vec3 triangleColor;
+		uniform float alpha;
+		uniform bool textured;
+		uniform sampler2D atlas;
+		uniform vec2 atlasCells;
+		uniform vec2 cell;
 		in vec2 screenPos;
+		in vec2 local;
 
 		out vec4 outColor;
 
 		void main()
 		{
 			float shadow = texture(los,(screenPos + vec2(1,1))/ 2).r;
-			if (shadow > 0.5){
+			if (!soft){
+				shadow = step(0.5, shadow);
+			}
+			// Anything in the dark can't be seen either
+			if (texture(lighting,(screenPos + vec2(1,1))/ 2).r < litThreshold){
+				shadow = 1.0;
+			}
+			if (ignoreLos){
+				shadow = 0.0;
+			}
+			if (shadow >= 1.0){
 				discard;
 			}
-			outColor = vec4(triangleColor, 1.0);
+			vec4 color = vec4(triangleColor, 1.0);
+			if (textured){
+				vec2 texLocal = clamp(local, 0.001, 0.999);
+				color = texture(atlas, (cell + vec2(texLocal.x, 1.0 - texLocal.y)) / atlasCells);
+			}
+			outColor = vec4(color.rgb, color.a * (1.0 - shadow) * alpha);
 		}
 		`)
+	draw.simpleQuadVAO = newVertexArray(draw.simpleQuad, draw.simpleShader,
+		vertexAttrib{"position", 2})
 
-	shader := gl.CreateProgram()
-	shader.AttachShader(vs)
-	shader.AttachShader(fs)
-	shader.BindFragDataLocation(0, "outColor")
-	shader.Link()
-	draw.simpleShader = shader
-
-	vs = compileShader(gl.VERTEX_SHADER, `
-		#version 150 compatibility
+	// Vertexes with a z of 1 are pushed away from origin, the viewer or a
+	// light, far past the edge of the screen
+	draw.losBlockerShader = createProgram(`
+		#version 150
 		in vec3 position;
+		uniform mat4 camera;
+		uniform vec2 origin;
 
 		void main()
 		{
-			vec4 pos = gl_ProjectionMatrix * gl_ModelViewMatrix * vec4(position, 1.0);
-			if (pos.z < 0){
-				pos.xy = normalize(pos.xy) * 10;
+			vec2 pos = position.xy;
+			if (position.z > 0.5){
+				pos = origin + normalize(pos - origin) * 1000.0;
 			}
-		    gl_Position = pos;
+		    gl_Position = camera * vec4(pos, 0.0, 1.0);
 		}
-		`)
-
-	fs = compileShader(gl.FRAGMENT_SHADER, `
+		`, `
 		#version 150
 		out float outColor;
 
@@ -120,34 +217,39 @@ func SetupOpengl(screenWidth, screenHeight int) (*Draw, error) {
 		    outColor = 1.0;
 		}
 		`)
+	draw.wallsVAO = newVertexArray(draw.walls, draw.losBlockerShader,
+		vertexAttrib{"position", 3})
 
-	shader = gl.CreateProgram()
-	shader.AttachShader(vs)
-	shader.AttachShader(fs)
-	shader.BindFragDataLocation(0, "outColor")
-	shader.Link()
-	draw.losBlockerShader = shader
-
-	vs = compileShader(gl.VERTEX_SHADER, `
-		#version 150 compatibility
+	draw.backgroundShader = createProgram(`
+		#version 150
 		in vec2 position;
 		out vec2 screenPos;
 		out vec2 worldPos;
+		uniform vec2 viewCenter;
+		uniform vec2 viewHalfSize;
 		void main()
 		{
-			worldPos = position;
-		    screenPos = (gl_ProjectionMatrix * gl_ModelViewMatrix * vec4(position, 0.0, 1.0)).xy;
+			worldPos = viewCenter + position * viewHalfSize;
+		    screenPos = position;
 		    gl_Position = vec4(screenPos, 0.0, 1.0);
 		}
-		`)
-
-	fs = compileShader(gl.FRAGMENT_SHADER, `
+		`, `
 		#version 150
 
 		in vec2 screenPos;
 		in vec2 worldPos;
 		out vec4 outColor;
 		uniform sampler2D los;
+		uniform sampler2D explored;
+		uniform sampler2D lighting;
+		uniform vec2 mapSize;
+		uniform bool soft;
+		uniform vec3 unlitFloor;
+		uniform vec3 litFloor;
+		uniform bool textured;
+		uniform sampler2D atlas;
+		uniform vec2 atlasCells;
+		uniform vec2 floorCell;
 
 		//From stack overflow
 		float rand(vec2 co){
@@ -157,46 +259,78 @@ func SetupOpengl(screenWidth, screenHeight int) (*Draw, error) {
 		void main()
 		{
 			float shadow = texture(los,(screenPos + vec2(1,1))/ 2).r;
-			if (shadow > 0.5){
-				float grayScale = rand(floor(worldPos * vec2(5,10)));
-				grayScale = round(grayScale) / 40 + 0.1;
-				outColor = vec4(grayScale, grayScale, grayScale, 1.0);
-			} else {
-			    outColor = vec4(0.7,0.7,0.7,1.0);
+			if (!soft){
+				shadow = step(0.5, shadow);
+			}
+			// Remembered floor is drawn as noise, and floor never seen is dark
+			float grayScale = rand(floor(worldPos * vec2(5,10)));
+			grayScale = round(grayScale) / 40 + 0.1;
+			float seen = texture(explored, (worldPos + vec2(0.5,0.5)) / mapSize).r;
+			vec4 memory = mix(vec4(0.02,0.02,0.02,1.0), vec4(grayScale, grayScale, grayScale, 1.0), seen);
+			float light = texture(lighting,(screenPos + vec2(1,1))/ 2).r;
+			vec3 visible = mix(unlitFloor, litFloor, light);
+			if (textured){
+				// A fully lit floor texture is shown as drawn
+				vec2 texLocal = clamp(fract(worldPos + vec2(0.5, 0.5)), 0.001, 0.999);
+				visible *= texture(atlas, (floorCell + vec2(texLocal.x, 1.0 - texLocal.y)) / atlasCells).rgb / litFloor;
 			}
+			outColor = mix(vec4(visible, 1.0), memory, shadow);
 		}
 		`)
+	draw.backgroundVAO = newVertexArray(draw.screenQuad, draw.backgroundShader,
+		vertexAttrib{"position", 2})
 
-	shader = gl.CreateProgram()
-	shader.AttachShader(vs)
-	shader.AttachShader(fs)
-	shader.BindFragDataLocation(0, "outColor")
-	shader.Link()
-	draw.backgroundShader = shader
-
-	vs = compileShader(gl.VERTEX_SHADER, `
-		#version 150 compatibility
+	draw.wallShader = createProgram(`
+		#version 150
 		in vec2 position;
+		in vec2 tilePos;
+		in float tileNeighbors;
+		in vec3 tileTint;
+		in vec2 tileCell;
 		out vec2 worldPos;
+		out vec2 mapPos;
+		flat out int neighbors;
+		flat out vec3 tint;
+		flat out vec2 cell;
+		uniform mat4 camera;
 		void main()
 		{
-			worldPos = position;
-		    gl_Position = (gl_ProjectionMatrix * gl_ModelViewMatrix * vec4(position, 0.0, 1.0));
+			worldPos = tilePos;
+			mapPos = position;
+			neighbors = int(tileNeighbors + 0.5);
+			tint = tileTint;
+			cell = tileCell;
+		    gl_Position = camera * vec4(position, 0.0, 1.0);
 		}
-		`)
-
-	fs = compileShader(gl.FRAGMENT_SHADER, `
+		`, `
 		#version 150
 
 		in vec2 worldPos;
+		in vec2 mapPos;
+		flat in int neighbors;
+		flat in vec3 tint;
+		flat in vec2 cell;
 		out vec4 outColor;
-		uniform int neighbors;
+		uniform sampler2D explored;
+		uniform vec2 mapSize;
+		uniform bool textured;
+		uniform sampler2D atlas;
+		uniform vec2 atlasCells;
 		// 210
 		// 4 3
 		// 765
 
 		void main()
 		{
+			// Walls never seen are hidden in the dark
+			float seen = texture(explored, (mapPos + vec2(0.5,0.5)) / mapSize).r;
+			if (textured){
+				vec2 texLocal = clamp(worldPos + vec2(0.5, 0.5), 0.001, 0.999);
+				vec4 texel = texture(atlas, (cell + vec2(texLocal.x, 1.0 - texLocal.y)) / atlasCells);
+				outColor = vec4(texel.rgb * mix(0.1, 1.0, seen), texel.a);
+				return;
+			}
+
 			float grayscale = 0.1 + clamp(sin((worldPos.x - worldPos.y) * 12.5663706144),0,1)/5;
 			if (worldPos.x < -0.3 && (neighbors & (1 << 4)) > 0){
 				grayscale = 0.3;
@@ -223,16 +357,266 @@ func SetupOpengl(screenWidth, screenHeight int) (*Draw, error) {
 				grayscale = 0.3;
 			}
 
-		    outColor = vec4(grayscale,grayscale,grayscale,1.0);
+		    outColor = vec4(vec3(grayscale,grayscale,grayscale) * tint * mix(0.1, 1.0, seen),1.0);
+		}
+		`)
+	draw.wallTilesVAO = newVertexArray(draw.wallTiles, draw.wallShader,
+		vertexAttrib{"position", 2}, vertexAttrib{"tilePos", 2},
+		vertexAttrib{"tileNeighbors", 1}, vertexAttrib{"tileTint", 3},
+		vertexAttrib{"tileCell", 2})
+
+	draw.visionShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 worldPos;
+		uniform vec2 viewCenter;
+		uniform vec2 viewHalfSize;
+		void main()
+		{
+			worldPos = viewCenter + position * viewHalfSize;
+		    gl_Position = vec4(position, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 worldPos;
+		out float outColor;
+		uniform vec2 origin;
+		uniform vec2 facing;
+		uniform float cosHalfFov;
+		uniform float peripheral;
+		uniform bool soft;
+		uniform vec2 falloff;
+
+		void main()
+		{
+			vec2 offset = worldPos - origin;
+			float dist = length(offset);
+			if (!soft){
+				if (dist <= peripheral || dot(offset / dist, facing) >= cosHalfFov){
+					discard;
+				}
+			    outColor = 1.0;
+			    return;
+			}
+
+			// Fade across the edges of the cone and the peripheral circle, and
+			// with distance
+			float cone = smoothstep(cosHalfFov - 0.05, cosHalfFov + 0.05, dot(offset / dist, facing));
+			float near = 1.0 - smoothstep(peripheral - 0.5, peripheral + 0.5, dist);
+			float visible = max(cone, near) * (1.0 - smoothstep(falloff.x, falloff.y, dist));
+		    outColor = 1.0 - visible;
+		}
+		`)
+	draw.visionVAO = newVertexArray(draw.screenQuad, draw.visionShader,
+		vertexAttrib{"position", 2})
+
+	// Adds one light's brightness wherever lightShadow doesn't block it,
+	// matching common.Light.Intensity
+	draw.lightShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 screenPos;
+		out vec2 worldPos;
+		uniform vec2 viewCenter;
+		uniform vec2 viewHalfSize;
+		void main()
+		{
+			worldPos = viewCenter + position * viewHalfSize;
+		    screenPos = position;
+		    gl_Position = vec4(position, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 screenPos;
+		in vec2 worldPos;
+		out float outColor;
+		uniform sampler2D lightShadow;
+		uniform vec2 lightPos;
+		uniform vec2 facing;
+		uniform float radius;
+		uniform float cosHalfFov;
+		uniform float glow;
+
+		void main()
+		{
+			vec2 offset = worldPos - lightPos;
+			float dist = length(offset);
+			if (dist >= radius){
+				discard;
+			}
+			if (dist > glow && dot(offset / dist, facing) < cosHalfFov){
+				discard;
+			}
+			float blocked = step(0.5, texture(lightShadow,(screenPos + vec2(1,1))/ 2).r);
+		    outColor = (1.0 - dist / radius) * (1.0 - blocked);
+		}
+		`)
+	draw.lightVAO = newVertexArray(draw.screenQuad, draw.lightShader,
+		vertexAttrib{"position", 2})
+
+	draw.blurShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 texPos;
+		void main()
+		{
+			texPos = (position + vec2(1,1)) / 2;
+		    gl_Position = vec4(position, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 texPos;
+		out float outColor;
+		uniform sampler2D source;
+		uniform vec2 direction;
+
+		const float weights[5] = float[](0.227027, 0.1945946, 0.1216216, 0.054054, 0.016216);
+
+		void main()
+		{
+			float sum = texture(source, texPos).r * weights[0];
+			for (int i = 1; i < 5; i++){
+				sum += texture(source, texPos + direction * i).r * weights[i];
+				sum += texture(source, texPos - direction * i).r * weights[i];
+			}
+		    outColor = sum;
+		}
+		`)
+	draw.blurVAO = newVertexArray(draw.screenQuad, draw.blurShader,
+		vertexAttrib{"position", 2})
+
+	// Copies one screen sized texture onto another, for blending
+	draw.copyShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 texPos;
+		void main()
+		{
+			texPos = (position + vec2(1,1)) / 2;
+		    gl_Position = vec4(position, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 texPos;
+		out float outColor;
+		uniform sampler2D source;
+
+		void main()
+		{
+		    outColor = texture(source, texPos).r;
+		}
+		`)
+	draw.copyVAO = newVertexArray(draw.screenQuad, draw.copyShader,
+		vertexAttrib{"position", 2})
+
+	// Covers the whole map, marking everything currently in sight as
+	// explored
+	draw.exploredShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 worldPos;
+		uniform vec2 mapSize;
+		void main()
+		{
+			worldPos = (position + vec2(1,1)) / 2 * mapSize - vec2(0.5, 0.5);
+		    gl_Position = vec4(position, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 worldPos;
+		out float outColor;
+		uniform sampler2D los;
+		uniform mat4 camera;
+
+		void main()
+		{
+			vec4 screenPos = camera * vec4(worldPos, 0.0, 1.0);
+			if (any(greaterThan(abs(screenPos.xy), vec2(1,1)))){
+				discard;
+			}
+			float shadow = texture(los,(screenPos.xy + vec2(1,1))/ 2).r;
+		    outColor = 1.0 - step(0.5, shadow);
+		}
+		`)
+	draw.exploredVAO = newVertexArray(draw.screenQuad, draw.exploredShader,
+		vertexAttrib{"position", 2})
+
+	draw.textShader = createProgram(`
+		#version 150
+		in vec2 position;
+		in vec2 texPos;
+		out vec2 fontPos;
+		uniform vec2 screenSize;
+		void main()
+		{
+			fontPos = texPos;
+		    gl_Position = vec4(position.x / screenSize.x * 2 - 1, 1 - position.y / screenSize.y * 2, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 fontPos;
+		out vec4 outColor;
+		uniform sampler2D font;
+		uniform vec3 textColor;
+
+		void main()
+		{
+			if (texture(font, fontPos).r < 0.5){
+				discard;
+			}
+		    outColor = vec4(textColor, 1.0);
 		}
 		`)
+	draw.textVAO = newVertexArray(draw.textBuffer, draw.textShader,
+		vertexAttrib{"position", 2}, vertexAttrib{"texPos", 2})
+	draw.createFont()
+
+	// Draws the minimap from a texture holding a texel per tile, and in dot
+	// mode the frame and the players on it
+	draw.minimapShader = createProgram(`
+		#version 150
+		in vec2 position;
+		out vec2 local;
+		uniform vec2 screenSize;
+		uniform vec4 rect;
+		void main()
+		{
+			local = (position + vec2(1,1)) / 2;
+			vec2 pixel = rect.xy + vec2(local.x, 1 - local.y) * rect.zw;
+		    gl_Position = vec4(pixel.x / screenSize.x * 2 - 1, 1 - pixel.y / screenSize.y * 2, 0.0, 1.0);
+		}
+		`, `
+		#version 150
+
+		in vec2 local;
+		out vec4 outColor;
+		uniform sampler2D tiles;
+		uniform sampler2D explored;
+		uniform bool fog;
+		uniform bool dot;
+		uniform vec3 dotColor;
 
-	shader = gl.CreateProgram()
-	shader.AttachShader(vs)
-	shader.AttachShader(fs)
-	shader.BindFragDataLocation(0, "outColor")
-	shader.Link()
-	draw.wallShader = shader
+		void main()
+		{
+			if (dot){
+				outColor = vec4(dotColor, 1.0);
+				return;
+			}
+			vec3 color = texture(tiles, local).rgb;
+			if (fog){
+				color *= mix(0.15, 1.0, texture(explored, local).r);
+			}
+		    outColor = vec4(color, 1.0);
+		}
+		`)
+	draw.minimapVAO = newVertexArray(draw.screenQuad, draw.minimapShader,
+		vertexAttrib{"position", 2})
 
 	return &draw, nil
 }
@@ -247,158 +631,769 @@ func compileShader(shaderType gl.GLenum, source string) gl.Shader {
 	return shader
 }
 
+func createProgram(vertexSource, fragmentSource string) gl.Program {
+	program := gl.CreateProgram()
+	program.AttachShader(compileShader(gl.VERTEX_SHADER, vertexSource))
+	program.AttachShader(compileShader(gl.FRAGMENT_SHADER, fragmentSource))
+	program.BindFragDataLocation(0, "outColor")
+	program.Link()
+	if program.Get(gl.LINK_STATUS) != gl.TRUE {
+		panic(errors.New("Error linking program: " + program.GetInfoLog()))
+	}
+	return program
+}
+
+type vertexAttrib struct {
+	name string
+	size uint
+}
+
+// newVertexArray describes how program reads its attributes, packed one
+// vertex after another, out of buffer.
+func newVertexArray(buffer gl.Buffer, program gl.Program, attribs ...vertexAttrib) gl.VertexArray {
+	stride := 0
+	for _, attrib := range attribs {
+		stride += int(attrib.size) * 4
+	}
+
+	vao := gl.GenVertexArray()
+	vao.Bind()
+	buffer.Bind(gl.ARRAY_BUFFER)
+	offset := 0
+	for _, attrib := range attribs {
+		location := program.GetAttribLocation(attrib.name)
+		location.AttribPointer(attrib.size, gl.FLOAT, false, stride, uintptr(offset))
+		location.EnableArray()
+		offset += int(attrib.size) * 4
+	}
+	buffer.Unbind(gl.ARRAY_BUFFER)
+	return vao
+}
+
+// quadTriangles splits quads, given as four corners going around the quad,
+// into the two triangles each that can actually be drawn.
+func quadTriangles(quads []float32, stride int) []float32 {
+	triangles := make([]float32, 0, len(quads)/2*3)
+	for quad := 0; quad+4*stride <= len(quads); quad += 4 * stride {
+		for _, corner := range []int{0, 1, 2, 0, 2, 3} {
+			triangles = append(triangles, quads[quad+corner*stride:quad+(corner+1)*stride]...)
+		}
+	}
+	return triangles
+}
+
 func (draw *Draw) createLosBuffer() {
-	draw.LOSfb = gl.GenFramebuffer()
-	draw.LOSfb.Bind()
+	draw.LOSfb, draw.LOStex = createTarget()
+	// Soft shadows are blurred through a second target and back
+	draw.blurFb, draw.blurTex = createTarget()
+	draw.exploredFb, draw.exploredTex = createTarget()
+	draw.imageFb, draw.imageTex = createTarget()
+	draw.lightFb, draw.lightTex = createTarget()
+	draw.lightShadowFb, draw.lightShadowTex = createTarget()
+	log.Println("====================================================")
+}
 
-	draw.LOStex = gl.GenTexture()
-	draw.LOStex.Bind(gl.TEXTURE_2D)
+// createTarget creates a framebuffer that renders into a texture. The
+// texture's storage is allocated separately.
+func createTarget() (gl.Framebuffer, gl.Texture) {
+	fb := gl.GenFramebuffer()
+	fb.Bind()
+
+	tex := gl.GenTexture()
+	tex.Bind(gl.TEXTURE_2D)
 
-	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8,
-		draw.screenWidth, draw.screenHeight,
-		0, gl.RED, gl.BYTE, nil)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
 	gl.FramebufferTexture2D(gl.FRAMEBUFFER, gl.COLOR_ATTACHMENT0,
-		gl.TEXTURE_2D, draw.LOStex, 0)
+		gl.TEXTURE_2D, tex, 0)
 
-	draw.LOStex.Unbind(gl.TEXTURE_2D)
-	draw.LOSfb.Unbind()
-	log.Println("====================================================")
+	tex.Unbind(gl.TEXTURE_2D)
+	fb.Unbind()
+	return fb, tex
+}
+
+// resize matches the viewport and the screen sized textures to a new
+// window size.
+func (draw *Draw) resize(screenWidth, screenHeight int) {
+	draw.screenWidth = screenWidth
+	draw.screenHeight = screenHeight
+	gl.Viewport(0, 0, screenWidth, screenHeight)
+
+	for _, tex := range []gl.Texture{draw.LOStex, draw.blurTex, draw.lightTex, draw.lightShadowTex} {
+		tex.Bind(gl.TEXTURE_2D)
+		gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8,
+			draw.screenWidth, draw.screenHeight,
+			0, gl.RED, gl.BYTE, nil)
+		tex.Unbind(gl.TEXTURE_2D)
+	}
+
+	draw.imageTex.Bind(gl.TEXTURE_2D)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8,
+		draw.screenWidth, draw.screenHeight,
+		0, gl.RGBA, gl.UNSIGNED_BYTE, nil)
+	draw.imageTex.Unbind(gl.TEXTURE_2D)
+}
+
+// Each tile owns a fixed slot in the walls buffer holding the shadow quads
+// for its right and top edges, so a changed tile only touches its own slot
+// and those of its left and bottom neighbors.
+const wallSlotFloats = 2 * 6 * 3 //quads * vertexes * floats
+
+func wallSlot(scene *Scene, i, j int) []float32 {
+	vertexes := make([]float32, 0, 2*4*3)
+	if scene.getWall(i, j).Solid() != scene.getWall(i+1, j).Solid() {
+		vertexes = append(vertexes,
+			float32(i)+0.5, float32(j)-0.5, 0,
+			float32(i)+0.5, float32(j)+0.5, 0,
+			float32(i)+0.5, float32(j)+0.5, 1,
+			float32(i)+0.5, float32(j)-0.5, 1)
+	}
+	if scene.getWall(i, j).Solid() != scene.getWall(i, j+1).Solid() {
+		vertexes = append(vertexes,
+			float32(i)-0.5, float32(j)+0.5, 0,
+			float32(i)+0.5, float32(j)+0.5, 0,
+			float32(i)+0.5, float32(j)+0.5, 1,
+			float32(i)-0.5, float32(j)+0.5, 1)
+	}
+	vertexes = quadTriangles(vertexes, 3)
+	// Unused edges are left as degenerate triangles
+	for len(vertexes) < wallSlotFloats {
+		vertexes = append(vertexes, 0)
+	}
+	return vertexes
 }
 
 func (draw *Draw) generateWalls(scene *Scene) {
-	vertexes := make([]float32, 0)
-	for i := 0; i < scene.width; i++ {
-		for j := 0; j < scene.height; j++ {
-			if (scene.getWall(i, j) == WallNone) != (scene.getWall(i+1, j) == WallNone) {
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)-0.5)
-				vertexes = append(vertexes, 0)
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 0)
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 1)
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)-0.5)
-				vertexes = append(vertexes, 1)
-			}
-			if (scene.getWall(i, j) == WallNone) != (scene.getWall(i, j+1) == WallNone) {
-				vertexes = append(vertexes, float32(i)-0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 0)
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 0)
-				vertexes = append(vertexes, float32(i)+0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 1)
-				vertexes = append(vertexes, float32(i)-0.5)
-				vertexes = append(vertexes, float32(j)+0.5)
-				vertexes = append(vertexes, 1)
-			}
+	vertexes := make([]float32, 0, scene.width*scene.height*wallSlotFloats)
+	for j := 0; j < scene.height; j++ {
+		for i := 0; i < scene.width; i++ {
+			vertexes = append(vertexes, wallSlot(scene, i, j)...)
 		}
 	}
 
 	draw.walls.Bind(gl.ARRAY_BUFFER)
-	gl.BufferData(gl.ARRAY_BUFFER, len(vertexes)*8, vertexes, gl.DYNAMIC_DRAW)
+	gl.BufferData(gl.ARRAY_BUFFER, len(vertexes)*4, vertexes, gl.DYNAMIC_DRAW)
 	draw.walls.Unbind(gl.ARRAY_BUFFER)
 	draw.wallLength = len(vertexes) / 3
 
+	draw.generateWallTiles(scene)
+	draw.generateMinimap(scene)
+	draw.resetExplored(scene)
+	scene.changed = scene.changed[:0]
 }
 
-func (draw *Draw) draw(scene *Scene, ops *OutputState) {
-	draw.LOSfb.Bind()
+// resetExplored forgets everything seen, sizing the explored texture for a
+// new map.
+func (draw *Draw) resetExplored(scene *Scene) {
+	draw.mapSize = [2]float32{float32(scene.width), float32(scene.height)}
+	draw.exploredTex.Bind(gl.TEXTURE_2D)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8,
+		scene.width*raster.ExploredResolution, scene.height*raster.ExploredResolution,
+		0, gl.RED, gl.BYTE, nil)
+	draw.exploredTex.Unbind(gl.TEXTURE_2D)
+
+	draw.exploredFb.Bind()
 	gl.Clear(gl.COLOR_BUFFER_BIT)
-	gl.MatrixMode(gl.PROJECTION)
-	gl.LoadIdentity()
-	gl.Ortho(
-		float64(-1*ops.screenBounds[0]/2/32),
-		float64(ops.screenBounds[0]/2/32),
-		float64(-1*ops.screenBounds[1]/2/32),
-		float64(ops.screenBounds[1]/2/32),
-		-10, 10)
-	gl.MatrixMode(gl.MODELVIEW)
-	gl.LoadIdentity()
-	gl.Translatef(ops.screenCenter[0]*-1, ops.screenCenter[1]*-1, 0)
+	draw.exploredFb.Unbind()
+}
 
-	draw.walls.Bind(gl.ARRAY_BUFFER)
-	draw.losBlockerShader.Use()
+// accumulateExplored adds what is currently in sight to the explored
+// texture.
+func (draw *Draw) accumulateExplored() {
+	draw.exploredFb.Bind()
+	gl.Viewport(0, 0, int(draw.mapSize[0])*raster.ExploredResolution, int(draw.mapSize[1])*raster.ExploredResolution)
+	gl.Enable(gl.BLEND)
+	gl.BlendEquation(gl.MAX)
+	gl.BlendFunc(gl.ONE, gl.ONE)
 
-	posAttrib := draw.losBlockerShader.GetAttribLocation("position")
-	posAttrib.AttribPointer(3, gl.FLOAT, false, 0, nil)
-	posAttrib.EnableArray()
+	draw.exploredShader.Use()
+	draw.exploredVAO.Bind()
+	gl.ActiveTexture(gl.TEXTURE0)
+	draw.LOStex.Bind(gl.TEXTURE_2D)
+	draw.exploredShader.GetUniformLocation("los").Uniform1i(0)
+	draw.exploredShader.GetUniformLocation("camera").UniformMatrix4fv(false, draw.camera)
+	draw.exploredShader.GetUniformLocation("mapSize").Uniform2f(draw.mapSize[0], draw.mapSize[1])
 
-	gl.DrawArrays(gl.QUADS, 0, draw.wallLength)
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
 
+	draw.LOStex.Unbind(gl.TEXTURE_2D)
+	gl.Disable(gl.BLEND)
+	gl.BlendEquation(gl.FUNC_ADD)
+	gl.Viewport(0, 0, draw.screenWidth, draw.screenHeight)
+	draw.exploredFb.Unbind()
+}
+
+// updateWalls rewrites the slots around tiles changed since the last frame.
+func (draw *Draw) updateWalls(scene *Scene) {
+	if len(scene.changed) == 0 {
+		return
+	}
+	draw.walls.Bind(gl.ARRAY_BUFFER)
+	for _, tile := range scene.changed {
+		for _, slot := range [][2]int{tile, {tile[0] - 1, tile[1]}, {tile[0], tile[1] - 1}} {
+			if slot[0] < 0 || slot[1] < 0 {
+				continue
+			}
+			offset := (slot[0] + slot[1]*scene.width) * wallSlotFloats * 4
+			gl.BufferSubData(gl.ARRAY_BUFFER, offset, wallSlotFloats*4, wallSlot(scene, slot[0], slot[1]))
+		}
+	}
 	draw.walls.Unbind(gl.ARRAY_BUFFER)
-	draw.LOSfb.Unbind()
+
+	// A tile's neighbors are drawn with an outline facing it, so they
+	// change along with it
+	draw.wallTiles.Bind(gl.ARRAY_BUFFER)
+	for _, tile := range scene.changed {
+		for i := tile[0] - 1; i <= tile[0]+1; i++ {
+			for j := tile[1] - 1; j <= tile[1]+1; j++ {
+				if i < 0 || j < 0 || i >= scene.width || j >= scene.height {
+					continue
+				}
+				offset := (i + j*scene.width) * wallTileFloats * 4
+				gl.BufferSubData(gl.ARRAY_BUFFER, offset, wallTileFloats*4, wallTile(scene, draw.atlas, i, j))
+			}
+		}
+	}
+	draw.wallTiles.Unbind(gl.ARRAY_BUFFER)
+
+	draw.minimapTiles.Bind(gl.TEXTURE_2D)
+	for _, tile := range scene.changed {
+		gl.TexSubImage2D(gl.TEXTURE_2D, 0, tile[0], tile[1], 1, 1,
+			gl.RGBA, gl.UNSIGNED_BYTE, minimapTexel(scene.getWall(tile[0], tile[1])))
+	}
+	draw.minimapTiles.Unbind(gl.TEXTURE_2D)
+	scene.changed = scene.changed[:0]
+}
+
+func minimapTexel(wall common.Wall) []byte {
+	color := raster.MinimapColor(wall)
+	return []byte{byte(color[0] * 255), byte(color[1] * 255), byte(color[2] * 255), 255}
+}
+
+// generateMinimap fills the minimap texture with a texel per tile, the
+// bottom row first like the map itself.
+func (draw *Draw) generateMinimap(scene *Scene) {
+	pixels := make([]byte, 0, scene.width*scene.height*4)
+	for j := 0; j < scene.height; j++ {
+		for i := 0; i < scene.width; i++ {
+			pixels = append(pixels, minimapTexel(scene.getWall(i, j))...)
+		}
+	}
+
+	if draw.minimapTiles == 0 {
+		draw.minimapTiles = gl.GenTexture()
+	}
+	draw.minimapTiles.Bind(gl.TEXTURE_2D)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8, scene.width, scene.height,
+		0, gl.RGBA, gl.UNSIGNED_BYTE, pixels)
+	draw.minimapTiles.Unbind(gl.TEXTURE_2D)
+}
+
+// drawMinimap draws the map, dimmed where unexplored if minimapFog is set,
+// with the dots collected from the entities on top.
+func (draw *Draw) drawMinimap() {
+	corner, pixelsPerTile := minimapLayout(
+		[2]float32{float32(draw.screenWidth), float32(draw.screenHeight)},
+		int(draw.mapSize[0]), int(draw.mapSize[1]))
+	size := [2]float32{draw.mapSize[0] * pixelsPerTile, draw.mapSize[1] * pixelsPerTile}
+
+	draw.minimapShader.Use()
+	draw.minimapVAO.Bind()
+	gl.ActiveTexture(gl.TEXTURE5)
+	draw.minimapTiles.Bind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE1)
+	draw.exploredTex.Bind(gl.TEXTURE_2D)
+	draw.minimapShader.GetUniformLocation("tiles").Uniform1i(5)
+	draw.minimapShader.GetUniformLocation("explored").Uniform1i(1)
+	draw.minimapShader.GetUniformLocation("fog").Uniform1i(boolInt(draw.minimapFog))
+	draw.minimapShader.GetUniformLocation("screenSize").Uniform2f(float32(draw.screenWidth), float32(draw.screenHeight))
+	rect := draw.minimapShader.GetUniformLocation("rect")
+	dot := draw.minimapShader.GetUniformLocation("dot")
+	dotColor := draw.minimapShader.GetUniformLocation("dotColor")
+
+	dot.Uniform1i(1)
+	dotColor.Uniform3f(0, 0, 0)
+	rect.Uniform4f(corner[0]-2, corner[1]-2, size[0]+4, size[1]+4)
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+
+	dot.Uniform1i(0)
+	rect.Uniform4f(corner[0], corner[1], size[0], size[1])
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+
+	dot.Uniform1i(1)
+	for _, d := range draw.dots {
+		position, width := d.rect(corner, pixelsPerTile, int(draw.mapSize[1]))
+		dotColor.Uniform3f(d.color[0], d.color[1], d.color[2])
+		rect.Uniform4f(position[0], position[1], width, width)
+		gl.DrawArrays(gl.TRIANGLES, 0, 6)
+	}
+
+	draw.exploredTex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE5)
+	draw.minimapTiles.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE0)
+}
+
+func (draw *Draw) minimapDot(position [2]float32, color [3]float32) {
+	draw.dots = append(draw.dots, minimapDot{position, color})
+}
+
+// The visible wall tiles are batched the same way as their shadows, each
+// tile owning two triangles in the wallTiles buffer. With an atlas, open
+// doors are drawn over the floor too.
+const wallTileStride = 2 + 2 + 1 + 3 + 2 //position, tile position, neighbors, tint, atlas cell
+const wallTileFloats = 6 * wallTileStride
+
+func wallTile(scene *Scene, atlas *raster.Atlas, i, j int) []float32 {
+	wall := scene.getWall(i, j)
+	if !wall.Solid() && (atlas == nil || wall == common.WallNone) {
+		return make([]float32, wallTileFloats)
+	}
+
+	neighbors := scene.isNotWall(i-1, j-1)<<7 |
+		scene.isNotWall(i, j-1)<<6 |
+		scene.isNotWall(i+1, j-1)<<5 |
+		scene.isNotWall(i-1, j)<<4 |
+		scene.isNotWall(i+1, j)<<3 |
+		scene.isNotWall(i-1, j+1)<<2 |
+		scene.isNotWall(i, j+1)<<1 |
+		scene.isNotWall(i+1, j+1)
+		// 210
+		// 4 3
+		// 765
+	tint := raster.WallTints[wall]
+	var cell [2]int
+	if atlas != nil {
+		cell = atlas.Walls[wall]
+	}
+
+	vertexes := make([]float32, 0, 4*wallTileStride)
+	for _, corner := range [][2]float32{{-0.5, -0.5}, {0.5, -0.5}, {0.5, 0.5}, {-0.5, 0.5}} {
+		vertexes = append(vertexes,
+			float32(i)+corner[0], float32(j)+corner[1],
+			corner[0], corner[1],
+			float32(neighbors),
+			tint[0], tint[1], tint[2],
+			float32(cell[0]), float32(cell[1]))
+	}
+	return quadTriangles(vertexes, wallTileStride)
+}
+
+func (draw *Draw) generateWallTiles(scene *Scene) {
+	vertexes := make([]float32, 0, scene.width*scene.height*wallTileFloats)
+	for j := 0; j < scene.height; j++ {
+		for i := 0; i < scene.width; i++ {
+			vertexes = append(vertexes, wallTile(scene, draw.atlas, i, j)...)
+		}
+	}
+
+	draw.wallTiles.Bind(gl.ARRAY_BUFFER)
+	gl.BufferData(gl.ARRAY_BUFFER, len(vertexes)*4, vertexes, gl.DYNAMIC_DRAW)
+	draw.wallTiles.Unbind(gl.ARRAY_BUFFER)
+	draw.wallTileLength = len(vertexes) / wallTileStride
+}
+
+func (draw *Draw) draw(scene *Scene, ops *OutputState) {
+	draw.alpha = ops.alpha
+	draw.dots = draw.dots[:0]
+	draw.updateWalls(scene)
+
+	viewHalfSize := [2]float32{
+		ops.screenBounds[0] / 2 / ops.pixelsPerTile,
+		ops.screenBounds[1] / 2 / ops.pixelsPerTile,
+	}
+	draw.camera = ortho(-viewHalfSize[0], viewHalfSize[0], -viewHalfSize[1], viewHalfSize[1]).
+		mul(translate(-ops.screenCenter[0], -ops.screenCenter[1]))
+
+	draw.drawSight(ops, viewHalfSize)
+
+	if draw.soft {
+		draw.blurLos(ops.pixelsPerTile)
+	}
+	draw.accumulateExplored()
+	draw.drawLights(ops.lights, ops.screenCenter, viewHalfSize)
 	/////////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////////
+	draw.target.Bind()
 	gl.Clear(gl.COLOR_BUFFER_BIT)
 	/////////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////////
+	gl.ActiveTexture(gl.TEXTURE3)
+	draw.atlasTex.Bind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE2)
+	draw.lightTex.Bind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE1)
+	draw.exploredTex.Bind(gl.TEXTURE_2D)
 	gl.ActiveTexture(gl.TEXTURE0)
 	draw.LOStex.Bind(gl.TEXTURE_2D)
-	draw.backgroundQuad.Bind(gl.ARRAY_BUFFER)
 	draw.backgroundShader.Use()
+	draw.backgroundVAO.Bind()
+	draw.backgroundShader.GetUniformLocation("los").Uniform1i(0)
+	draw.backgroundShader.GetUniformLocation("explored").Uniform1i(1)
+	draw.backgroundShader.GetUniformLocation("lighting").Uniform1i(2)
+	draw.backgroundShader.GetUniformLocation("unlitFloor").Uniform3f(raster.UnlitFloor[0], raster.UnlitFloor[1], raster.UnlitFloor[2])
+	draw.backgroundShader.GetUniformLocation("litFloor").Uniform3f(raster.LitFloor[0], raster.LitFloor[1], raster.LitFloor[2])
+	draw.setAtlasUniforms(draw.backgroundShader)
+	if draw.atlas != nil {
+		floorCell := draw.atlas.Walls[common.WallNone]
+		draw.backgroundShader.GetUniformLocation("floorCell").Uniform2f(float32(floorCell[0]), float32(floorCell[1]))
+	}
+	draw.backgroundShader.GetUniformLocation("mapSize").Uniform2f(draw.mapSize[0], draw.mapSize[1])
 
-	posAttrib = draw.simpleShader.GetAttribLocation("position")
-	posAttrib.AttribPointer(2, gl.FLOAT, false, 0, nil)
-	posAttrib.EnableArray()
-
-	gl.DrawArrays(gl.QUADS, 0, 4)
+	draw.backgroundShader.GetUniformLocation("viewCenter").Uniform2f(ops.screenCenter[0], ops.screenCenter[1])
+	draw.backgroundShader.GetUniformLocation("viewHalfSize").Uniform2f(viewHalfSize[0], viewHalfSize[1])
+	draw.backgroundShader.GetUniformLocation("soft").Uniform1i(boolInt(draw.soft))
 
-	draw.backgroundQuad.Unbind(gl.ARRAY_BUFFER)
-	draw.LOStex.Unbind(gl.TEXTURE_2D)
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
 	/////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////
-	draw.simpleQuad.Bind(gl.ARRAY_BUFFER)
 	draw.wallShader.Use()
+	draw.wallTilesVAO.Bind()
+	draw.wallShader.GetUniformLocation("camera").UniformMatrix4fv(false, draw.camera)
+	draw.wallShader.GetUniformLocation("explored").Uniform1i(1)
+	draw.wallShader.GetUniformLocation("mapSize").Uniform2f(draw.mapSize[0], draw.mapSize[1])
+	draw.setAtlasUniforms(draw.wallShader)
 
-	posAttrib = draw.wallShader.GetAttribLocation("position")
-	posAttrib.AttribPointer(2, gl.FLOAT, false, 0, nil)
-	posAttrib.EnableArray()
-
-	neighborsAttrib := draw.wallShader.GetUniformLocation("neighbors")
-	for i := 0; i < scene.width; i++ {
-		for j := 0; j < scene.width; j++ {
-			if scene.getWall(i, j) == WallStone {
-				var neighbors int = scene.isNotWall(i-1, j-1)<<7 |
-					scene.isNotWall(i, j-1)<<6 |
-					scene.isNotWall(i+1, j-1)<<5 |
-					scene.isNotWall(i-1, j)<<4 |
-					scene.isNotWall(i+1, j)<<3 |
-					scene.isNotWall(i-1, j+1)<<2 |
-					scene.isNotWall(i, j+1)<<1 |
-					scene.isNotWall(i+1, j+1)
-					// 210
-					// 4 3
-					// 765
-				neighborsAttrib.Uniform1i(neighbors)
-				_ = neighbors
-				gl.PushMatrix()
-				gl.Translatef(float32(i), float32(j), 0)
-				gl.DrawArrays(gl.QUADS, 0, 4)
-				gl.PopMatrix()
-			}
-		}
-	}
+	// Textures may be partly transparent
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.SRC_ALPHA, gl.ONE_MINUS_SRC_ALPHA)
+	gl.DrawArrays(gl.TRIANGLES, 0, draw.wallTileLength)
+	gl.Disable(gl.BLEND)
 	/////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////
-	draw.simpleShader.Use()
-	draw.LOStex.Bind(gl.TEXTURE_2D)
-
-	posAttrib = draw.simpleShader.GetAttribLocation("position")
-	posAttrib.AttribPointer(2, gl.FLOAT, false, 0, nil)
-	posAttrib.EnableArray()
-
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.SRC_ALPHA, gl.ONE_MINUS_SRC_ALPHA)
 	for _, entity := range scene.entities {
 		entity.draw(draw)
 	}
+	gl.Disable(gl.BLEND)
 
-	draw.simpleQuad.Unbind(gl.ARRAY_BUFFER)
 	draw.LOStex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE1)
+	draw.exploredTex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE2)
+	draw.lightTex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE3)
+	draw.atlasTex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE0)
+
+	if ops.minimap {
+		draw.drawMinimap()
+	}
+	drawHud(draw, ops)
+	draw.target.Unbind()
+}
+
+// setAtlas uploads the atlas image for the shaders to sample, on texture
+// unit 3 while drawing.
+func (draw *Draw) setAtlas(atlas *raster.Atlas) {
+	draw.atlas = atlas
+	if atlas == nil {
+		return
+	}
+	if draw.atlasTex == 0 {
+		draw.atlasTex = gl.GenTexture()
+	}
+	draw.atlasTex.Bind(gl.TEXTURE_2D)
+	// Pixel art stays crisp when zoomed in
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA8,
+		atlas.Image.Bounds().Dx(), atlas.Image.Bounds().Dy(),
+		0, gl.RGBA, gl.UNSIGNED_BYTE, atlas.Image.Pix)
+	draw.atlasTex.Unbind(gl.TEXTURE_2D)
+}
+
+func (draw *Draw) setAtlasUniforms(program gl.Program) {
+	program.GetUniformLocation("textured").Uniform1i(boolInt(draw.atlas != nil))
+	program.GetUniformLocation("atlas").Uniform1i(3)
+	if draw.atlas != nil {
+		cells := draw.atlas.Cells()
+		program.GetUniformLocation("atlasCells").Uniform2f(cells[0], cells[1])
+	}
+}
+
+// drawSight fills LOStex with the shadow of everything none of the viewers
+// can see. Each viewer's shadow is drawn into lightShadowTex, which is free
+// until the lights are drawn, and kept in LOStex where it is lighter.
+func (draw *Draw) drawSight(ops *OutputState, viewHalfSize [2]float32) {
+	draw.LOSfb.Bind()
+	gl.ClearColor(1, 1, 1, 1)
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	gl.ClearColor(0, 0, 0, 0)
+	draw.LOSfb.Unbind()
+
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.ONE, gl.ONE)
+	for _, viewer := range ops.viewers() {
+		draw.lightShadowFb.Bind()
+		gl.Clear(gl.COLOR_BUFFER_BIT)
+		// Overlapping shadows keep the darkest value
+		gl.BlendEquation(gl.MAX)
+
+		draw.wallShadows(viewer.Position)
+
+		// Everything outside the vision cone is shadowed too
+		draw.visionShader.Use()
+		draw.visionVAO.Bind()
+		draw.visionShader.GetUniformLocation("viewCenter").Uniform2f(ops.screenCenter[0], ops.screenCenter[1])
+		draw.visionShader.GetUniformLocation("viewHalfSize").Uniform2f(viewHalfSize[0], viewHalfSize[1])
+		draw.visionShader.GetUniformLocation("origin").Uniform2f(viewer.Position[0], viewer.Position[1])
+		draw.visionShader.GetUniformLocation("facing").Uniform2f(viewer.Facing[0], viewer.Facing[1])
+		draw.visionShader.GetUniformLocation("cosHalfFov").Uniform1f(float32(math.Cos(float64(ops.vision.Fov) / 2)))
+		draw.visionShader.GetUniformLocation("peripheral").Uniform1f(ops.vision.Peripheral)
+		draw.visionShader.GetUniformLocation("soft").Uniform1i(boolInt(draw.soft))
+		draw.visionShader.GetUniformLocation("falloff").Uniform2f(softFalloffStart, softFalloffEnd)
+		gl.DrawArrays(gl.TRIANGLES, 0, 6)
+		draw.lightShadowFb.Unbind()
+
+		// Anywhere any viewer sees is in sight
+		draw.LOSfb.Bind()
+		gl.BlendEquation(gl.MIN)
+		draw.copyShader.Use()
+		draw.copyVAO.Bind()
+		gl.ActiveTexture(gl.TEXTURE0)
+		draw.lightShadowTex.Bind(gl.TEXTURE_2D)
+		draw.copyShader.GetUniformLocation("source").Uniform1i(0)
+		gl.DrawArrays(gl.TRIANGLES, 0, 6)
+		draw.lightShadowTex.Unbind(gl.TEXTURE_2D)
+		draw.LOSfb.Unbind()
+	}
+	gl.Disable(gl.BLEND)
+	gl.BlendEquation(gl.FUNC_ADD)
+}
+
+// wallShadows draws the shadows walls cast away from origin, into whatever
+// target is bound.
+func (draw *Draw) wallShadows(origin [2]float32) {
+	draw.losBlockerShader.Use()
+	draw.wallsVAO.Bind()
+	draw.losBlockerShader.GetUniformLocation("camera").UniformMatrix4fv(false, draw.camera)
+	draw.losBlockerShader.GetUniformLocation("origin").Uniform2f(origin[0], origin[1])
+
+	gl.DrawArrays(gl.TRIANGLES, 0, draw.wallLength)
+}
+
+// drawLights adds up how lit the screen is into lightTex, one light at a
+// time, each shadowed by the walls in its way through lightShadowTex.
+func (draw *Draw) drawLights(lights []common.Light, viewCenter, viewHalfSize [2]float32) {
+	draw.lightFb.Bind()
+	gl.Clear(gl.COLOR_BUFFER_BIT)
+	draw.lightFb.Unbind()
+
+	reach := math.Hypot(float64(viewHalfSize[0]), float64(viewHalfSize[1]))
+	gl.Enable(gl.BLEND)
+	gl.BlendFunc(gl.ONE, gl.ONE)
+	for _, light := range lights {
+		// Lights too far away to reach the screen are skipped
+		dist := math.Hypot(float64(light.Position[0]-viewCenter[0]), float64(light.Position[1]-viewCenter[1]))
+		if dist >= float64(light.Radius)+reach {
+			continue
+		}
+
+		draw.lightShadowFb.Bind()
+		gl.Clear(gl.COLOR_BUFFER_BIT)
+		gl.BlendEquation(gl.MAX)
+		draw.wallShadows(light.Position)
+		draw.lightShadowFb.Unbind()
+
+		draw.lightFb.Bind()
+		gl.BlendEquation(gl.FUNC_ADD)
+		draw.lightShader.Use()
+		draw.lightVAO.Bind()
+		gl.ActiveTexture(gl.TEXTURE0)
+		draw.lightShadowTex.Bind(gl.TEXTURE_2D)
+		draw.lightShader.GetUniformLocation("lightShadow").Uniform1i(0)
+		draw.lightShader.GetUniformLocation("viewCenter").Uniform2f(viewCenter[0], viewCenter[1])
+		draw.lightShader.GetUniformLocation("viewHalfSize").Uniform2f(viewHalfSize[0], viewHalfSize[1])
+		draw.lightShader.GetUniformLocation("lightPos").Uniform2f(light.Position[0], light.Position[1])
+		draw.lightShader.GetUniformLocation("facing").Uniform2f(light.Facing[0], light.Facing[1])
+		draw.lightShader.GetUniformLocation("radius").Uniform1f(light.Radius)
+		draw.lightShader.GetUniformLocation("cosHalfFov").Uniform1f(float32(math.Cos(float64(light.Fov) / 2)))
+		draw.lightShader.GetUniformLocation("glow").Uniform1f(light.Glow)
+		gl.DrawArrays(gl.TRIANGLES, 0, 6)
+		draw.lightShadowTex.Unbind(gl.TEXTURE_2D)
+		draw.lightFb.Unbind()
+	}
+	gl.Disable(gl.BLEND)
+}
+
+// The distance in tiles over which soft shadows fade to darkness
+const softFalloffStart = 8
+const softFalloffEnd = 14
+
+// blurLos softens the edges of the line of sight texture, blurring it
+// across into blurTex and then back down into LOStex.
+func (draw *Draw) blurLos(pixelsPerTile float32) {
+	draw.blurShader.Use()
+	draw.blurVAO.Bind()
+	gl.ActiveTexture(gl.TEXTURE0)
+	draw.blurShader.GetUniformLocation("source").Uniform1i(0)
+	direction := draw.blurShader.GetUniformLocation("direction")
+	// The penumbra is about a quarter of a tile wide at any zoom
+	spread := pixelsPerTile / 32
+
+	draw.blurFb.Bind()
+	draw.LOStex.Bind(gl.TEXTURE_2D)
+	direction.Uniform2f(spread/float32(draw.screenWidth), 0)
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+	draw.blurFb.Unbind()
+
+	draw.LOSfb.Bind()
+	draw.blurTex.Bind(gl.TEXTURE_2D)
+	direction.Uniform2f(0, spread/float32(draw.screenHeight))
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+	draw.LOSfb.Unbind()
+
+	draw.blurTex.Unbind(gl.TEXTURE_2D)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (draw *Draw) interpolation() float32 {
+	return draw.alpha
+}
+
+// sprite draws a one tile player at position, from the atlas or as a
+// square of a single color, hidden wherever it is out of sight or unlit and
+// fading out at the edge of sight.
+func (draw *Draw) sprite(position [2]float32, state common.PlayerState, color [3]float32) {
+	draw.simpleQuadAt(translate(position[0], position[1]), draw.spriteCell(state), color, 1, false)
+}
+
+// ghost draws a small translucent marker at position, even out of sight.
+func (draw *Draw) ghost(position [2]float32, state common.PlayerState, color [3]float32, alpha float32) {
+	draw.simpleQuadAt(translate(position[0], position[1]).mul(scale(0.6, 0.6)), draw.spriteCell(state), color, alpha, true)
+}
+
+func (draw *Draw) effect(position, size [2]float32, color [3]float32, alpha float32, ignoreLos bool) {
+	draw.simpleQuadAt(translate(position[0], position[1]).mul(scale(size[0], size[1])), nil, color, alpha, ignoreLos)
+}
+
+// spriteCell returns the atlas cell for a player state, or nil when there
+// is no atlas.
+func (draw *Draw) spriteCell(state common.PlayerState) *[2]int {
+	if draw.atlas == nil {
+		return nil
+	}
+	cell := draw.atlas.Players[state]
+	return &cell
+}
+
+// simpleQuadAt draws a quad textured with an atlas cell, or of a single
+// color when cell is nil.
+func (draw *Draw) simpleQuadAt(model matrix, cell *[2]int, color [3]float32, alpha float32, ignoreLos bool) {
+	draw.simpleShader.Use()
+	draw.simpleQuadVAO.Bind()
+	draw.simpleShader.GetUniformLocation("camera").UniformMatrix4fv(false, draw.camera)
+	draw.simpleShader.GetUniformLocation("model").UniformMatrix4fv(false, model)
+	draw.simpleShader.GetUniformLocation("triangleColor").Uniform3f(color[0], color[1], color[2])
+	draw.simpleShader.GetUniformLocation("alpha").Uniform1f(alpha)
+	draw.simpleShader.GetUniformLocation("soft").Uniform1i(boolInt(draw.soft))
+	draw.simpleShader.GetUniformLocation("ignoreLos").Uniform1i(boolInt(ignoreLos))
+	draw.simpleShader.GetUniformLocation("lighting").Uniform1i(2)
+	draw.simpleShader.GetUniformLocation("litThreshold").Uniform1f(common.LitThreshold)
+	draw.setAtlasUniforms(draw.simpleShader)
+	if cell != nil {
+		draw.simpleShader.GetUniformLocation("cell").Uniform2f(float32(cell[0]), float32(cell[1]))
+	} else {
+		draw.simpleShader.GetUniformLocation("textured").Uniform1i(0)
+	}
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+}
+
+// The font texture holds every printable ASCII character in one row
+const fontFirst = ' '
+const fontLast = '~'
+const fontGlyphs = fontLast - fontFirst + 1
+
+func (draw *Draw) createFont() {
+	width := int(fontGlyphs) * raster.GlyphWidth
+	pixels := make([]byte, width*raster.GlyphHeight)
+	for r := rune(fontFirst); r <= fontLast; r++ {
+		glyph := raster.Glyph(r)
+		for row := 0; row < raster.GlyphHeight; row++ {
+			for column := 0; column < raster.GlyphWidth; column++ {
+				if glyph[row]&(1<<uint(raster.GlyphWidth-1-column)) != 0 {
+					pixels[row*width+int(r-fontFirst)*raster.GlyphWidth+column] = 255
+				}
+			}
+		}
+	}
+
+	draw.fontTex = gl.GenTexture()
+	draw.fontTex.Bind(gl.TEXTURE_2D)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexImage2D(gl.TEXTURE_2D, 0, gl.R8, width, raster.GlyphHeight,
+		0, gl.RED, gl.UNSIGNED_BYTE, pixels)
+	draw.fontTex.Unbind(gl.TEXTURE_2D)
+}
+
+// text draws on texture unit 4, so it never disturbs the textures bound
+// for the rest of the frame.
+func (draw *Draw) text(position [2]float32, text string, color [3]float32) {
+	if text == "" {
+		return
+	}
+	glyphWidth := float32(raster.GlyphWidth * textScale)
+	glyphHeight := float32(raster.GlyphHeight * textScale)
+	vertexes := make([]float32, 0, len(text)*4*4)
+	x := position[0]
+	for _, r := range text {
+		if r < fontFirst || r > fontLast {
+			r = '?'
+		}
+		left := float32(r-fontFirst) / fontGlyphs
+		right := float32(r-fontFirst+1) / fontGlyphs
+		vertexes = append(vertexes,
+			x, position[1]+glyphHeight, left, 1,
+			x+glyphWidth, position[1]+glyphHeight, right, 1,
+			x+glyphWidth, position[1], right, 0,
+			x, position[1], left, 0)
+		x += float32((raster.GlyphWidth + 1) * textScale)
+	}
+	vertexes = quadTriangles(vertexes, 4)
+
+	draw.textBuffer.Bind(gl.ARRAY_BUFFER)
+	gl.BufferData(gl.ARRAY_BUFFER, len(vertexes)*4, vertexes, gl.STREAM_DRAW)
+	draw.textBuffer.Unbind(gl.ARRAY_BUFFER)
+
+	draw.textShader.Use()
+	draw.textVAO.Bind()
+	gl.ActiveTexture(gl.TEXTURE4)
+	draw.fontTex.Bind(gl.TEXTURE_2D)
+	draw.textShader.GetUniformLocation("font").Uniform1i(4)
+	draw.textShader.GetUniformLocation("screenSize").Uniform2f(float32(draw.screenWidth), float32(draw.screenHeight))
+	draw.textShader.GetUniformLocation("textColor").Uniform3f(color[0], color[1], color[2])
+	gl.DrawArrays(gl.TRIANGLES, 0, len(vertexes)/4)
+	draw.fontTex.Unbind(gl.TEXTURE_2D)
+	gl.ActiveTexture(gl.TEXTURE0)
+}
+
+// toScreen returns the screen pixel, from the top left, that a world
+// position is drawn at. The camera only ever scales and moves.
+func (draw *Draw) toScreen(position [2]float32) [2]float32 {
+	x := draw.camera[0]*position[0] + draw.camera[12]
+	y := draw.camera[5]*position[1] + draw.camera[13]
+	return [2]float32{
+		(x + 1) / 2 * float32(draw.screenWidth),
+		(1 - y) / 2 * float32(draw.screenHeight),
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"math"
+	"math/rand"
+)
+
+// Particle is a small square that drifts, slows down and fades out.
+type Particle struct {
+	position [2]float32
+	velocity [2]float32
+	color    [3]float32
+	size     float32
+	age      int
+	lifetime int
+}
+
+// Ring is an expanding circle where a noise was heard.
+type Ring struct {
+	position [2]float32
+	radius   float32
+	age      int
+}
+
+// Effects turns server events and player movement into particles: bursts
+// where someone is tagged, footprints behind everyone moving, and rings
+// where noises are heard.
+type Effects struct {
+	bursts     []Particle
+	footprints []Particle
+	rings      []Ring
+	// Where each player was last tick, how far they have gone since their
+	// last footprint, and which foot is next
+	lastPositions map[int][2]float32
+	strides       map[int]float32
+	leftFoot      map[int]bool
+	tick          int
+}
+
+func newEffects() *Effects {
+	return &Effects{
+		lastPositions: make(map[int][2]float32),
+		strides:       make(map[int]float32),
+		leftFoot:      make(map[int]bool),
+	}
+}
+
+const burstParticles = 24
+const burstLifetime = common.TickRate * 2 / 3
+const burstSpeed = 0.15
+
+// Particles lose this much of their speed every tick
+const particleDrag = 0.9
+
+const footprintLifetime = 2 * common.TickRate
+const strideLength = 0.8
+
+// Moving further than this in a tick is a jump, not a step
+const maxStep = 1
+
+const ringLifetime = common.TickRate
+
+// Rings grow to this fraction of how far the noise carried, so louder noises
+// make bigger rings without covering the screen
+const ringScale = 0.25
+const ringSegments = 24
+
+var ringColor = [3]float32{1, 0.85, 0.5}
+
+// The pulse of the outline around invincible players, in ticks
+const pulsePeriod = common.TickRate / 2
+
+var footprintColor = [3]float32{0.15, 0.13, 0.1}
+
+func (effects *Effects) event(event common.Event) {
+	switch event.Kind {
+	case common.EventTag:
+		effects.burst(event.Position, stateColors[common.PlayerIt])
+		effects.burst(event.Position, stateColors[common.PlayerInvincible])
+	case common.EventNoise:
+		effects.rings = append(effects.rings, Ring{event.Position, event.Radius * ringScale, 0})
+	}
+}
+
+func (effects *Effects) burst(position [2]float32, color [3]float32) {
+	for i := 0; i < burstParticles/2; i++ {
+		angle := rand.Float64() * 2 * math.Pi
+		speed := burstSpeed * (0.5 + rand.Float64()/2)
+		effects.bursts = append(effects.bursts, Particle{
+			position: position,
+			velocity: [2]float32{float32(math.Cos(angle) * speed), float32(math.Sin(angle) * speed)},
+			color:    color,
+			size:     0.1 + rand.Float32()*0.1,
+			lifetime: burstLifetime,
+		})
+	}
+}
+
+// step moves the particles along, and leaves footprints behind the players
+// that moved since the last tick, returning where the new ones are.
+func (effects *Effects) step(enemies []Enemy) [][2]float32 {
+	effects.tick++
+	effects.bursts = stepParticles(effects.bursts)
+	effects.footprints = stepParticles(effects.footprints)
+	rings := effects.rings[:0]
+	for _, ring := range effects.rings {
+		ring.age++
+		if ring.age < ringLifetime {
+			rings = append(rings, ring)
+		}
+	}
+	effects.rings = rings
+
+	var steps [][2]float32
+	positions := make(map[int][2]float32)
+	for _, enemy := range enemies {
+		positions[enemy.id] = enemy.position
+		last, ok := effects.lastPositions[enemy.id]
+		if !ok {
+			continue
+		}
+		delta := [2]float32{enemy.position[0] - last[0], enemy.position[1] - last[1]}
+		dist := float32(math.Hypot(float64(delta[0]), float64(delta[1])))
+		if dist == 0 || dist > maxStep {
+			continue
+		}
+		effects.strides[enemy.id] += dist
+		if effects.strides[enemy.id] < strideLength {
+			continue
+		}
+		effects.strides[enemy.id] = 0
+
+		// Alternate feet on either side of the direction of travel
+		side := float32(0.15)
+		if effects.leftFoot[enemy.id] {
+			side = -side
+		}
+		effects.leftFoot[enemy.id] = !effects.leftFoot[enemy.id]
+		position := [2]float32{
+			enemy.position[0] - delta[1]/dist*side,
+			enemy.position[1] + delta[0]/dist*side,
+		}
+		steps = append(steps, position)
+		effects.footprints = append(effects.footprints, Particle{
+			position: position,
+			color:    footprintColor,
+			size:     0.15,
+			lifetime: footprintLifetime,
+		})
+	}
+	// Players out of sight start over when they come back
+	effects.lastPositions = positions
+	return steps
+}
+
+func stepParticles(particles []Particle) []Particle {
+	alive := particles[:0]
+	for _, particle := range particles {
+		particle.age++
+		if particle.age >= particle.lifetime {
+			continue
+		}
+		particle.position[0] += particle.velocity[0]
+		particle.position[1] += particle.velocity[1]
+		particle.velocity[0] *= particleDrag
+		particle.velocity[1] *= particleDrag
+		alive = append(alive, particle)
+	}
+	return alive
+}
+
+func (effects *Effects) drawFootprints(draw Renderer) {
+	drawParticles(draw, effects.footprints, 0.6)
+}
+
+func (effects *Effects) drawBursts(draw Renderer) {
+	drawParticles(draw, effects.bursts, 1)
+}
+
+// drawRings draws the noise rings, which show through walls since noises are
+// heard out of sight.
+func (effects *Effects) drawRings(draw Renderer) {
+	for _, ring := range effects.rings {
+		progress := float32(ring.age) / ringLifetime
+		radius := float64(ring.radius * progress)
+		for i := 0; i < ringSegments; i++ {
+			angle := float64(i) * 2 * math.Pi / ringSegments
+			position := [2]float32{
+				ring.position[0] + float32(math.Cos(angle)*radius),
+				ring.position[1] + float32(math.Sin(angle)*radius),
+			}
+			draw.effect(position, [2]float32{0.15, 0.15}, ringColor, 1-progress, true)
+		}
+	}
+}
+
+func drawParticles(draw Renderer, particles []Particle, alpha float32) {
+	for _, particle := range particles {
+		fade := 1 - float32(particle.age)/float32(particle.lifetime)
+		draw.effect(particle.position, [2]float32{particle.size, particle.size}, particle.color, alpha*fade, false)
+	}
+}
+
+// drawOutline draws a pulsing square outline around an invincible player.
+func (effects *Effects) drawOutline(draw Renderer, position [2]float32) {
+	pulse := 0.5 + 0.5*float32(math.Sin(float64(effects.tick)*2*math.Pi/pulsePeriod))
+	color := stateColors[common.PlayerInvincible]
+	const size = 1.3
+	const width = 0.08
+	for _, side := range [][2]float32{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		center := [2]float32{position[0] + side[0]*(size-width)/2, position[1] + side[1]*(size-width)/2}
+		bar := [2]float32{width, size}
+		if side[0] == 0 {
+			bar = [2]float32{size, width}
+		}
+		draw.effect(center, bar, color, 0.3+0.7*pulse, false)
+	}
+}
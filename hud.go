@@ -0,0 +1,282 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/line-of-sight/raster"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hud is what the heads up display shows, kept up to date by serverConn.
+type Hud struct {
+	connected      bool
+	lastUpdate     time.Time
+	ping           time.Duration
+	id             int
+	state          common.PlayerState
+	invincibleTime int
+	scoreboard     []common.Score
+	stamina        common.Stamina
+	round          common.Round
+	// The heist round, or nil in the tag mode
+	heist *common.Heist
+	team  int
+}
+
+// Text is drawn with this many screen pixels per font pixel
+const textScale = 2
+const lineHeight = (raster.GlyphHeight + 3) * textScale
+const hudMargin = 10
+
+// No update for this long means the connection has been lost
+const staleUpdate = 2 * time.Second
+
+var stateColors = map[common.PlayerState][3]float32{
+	common.PlayerRun:        {0.3, 1.0, 0.3},
+	common.PlayerIt:         {1.0, 0.3, 0.2},
+	common.PlayerInvincible: {1.0, 1.0, 1.0},
+	common.PlayerCaught:     {0.5, 0.5, 0.5},
+}
+
+var white = [3]float32{1, 1, 1}
+var lootColor = [3]float32{1.0, 0.8, 0.2}
+var exitColor = [3]float32{0.2, 0.9, 0.4}
+
+// drawHud draws the heads up display over everything else: the player's
+// tag state and connection in the top left, the round at the top in the
+// middle, and the scoreboard in the top right, or the results in the middle
+// between rounds.
+func drawHud(draw Renderer, ops *OutputState) {
+	hud := ops.hud
+	if hud == nil {
+		return
+	}
+
+	y := float32(hudMargin)
+	line := func(text string, color [3]float32) {
+		shadowedText(draw, [2]float32{hudMargin, y}, text, color)
+		y += lineHeight
+	}
+
+	if !hud.connected {
+		line("Connecting...", white)
+		return
+	}
+	switch hud.state {
+	case common.PlayerRun:
+		line("Run!", stateColors[hud.state])
+	case common.PlayerIt:
+		line("You're it!", stateColors[hud.state])
+	case common.PlayerInvincible:
+		seconds := float64(hud.invincibleTime) / common.TickRate
+		line("Invincible "+strconv.FormatFloat(seconds, 'f', 1, 64)+"s", stateColors[hud.state])
+	case common.PlayerCaught:
+		line("Caught!", stateColors[hud.state])
+	}
+	if hud.heist != nil {
+		drawHeist(hud, line)
+	}
+	line("Stamina "+staminaBar(hud.stamina), staminaColor(hud.stamina))
+	if time.Since(hud.lastUpdate) > staleUpdate {
+		line("Connection lost", stateColors[common.PlayerIt])
+	} else {
+		line("Ping "+strconv.Itoa(int(hud.ping/time.Millisecond))+"ms", white)
+	}
+
+	scores := make([]common.Score, len(hud.scoreboard))
+	copy(scores, hud.scoreboard)
+	sort.Sort(byPoints(scores))
+	lines := []string{pad("Players: "+strconv.Itoa(len(scores)), scoreWidth-4) + " Pts"}
+	for _, score := range scores {
+		marker := "  "
+		if score.Id == hud.id {
+			marker = "> "
+		}
+		lines = append(lines, pad(marker+score.Name, scoreWidth-4)+padLeft(strconv.Itoa(points(score)), 4))
+	}
+	x := ops.screenBounds[0] - hudMargin - float32(raster.TextWidth(lines[0])*textScale)
+	y = hudMargin
+	line = func(text string, color [3]float32) {
+		shadowedText(draw, [2]float32{x, y}, text, color)
+		y += lineHeight
+	}
+	line(lines[0], white)
+	for i, score := range scores {
+		line(lines[i+1], stateColors[score.State])
+	}
+
+	drawRound(draw, ops, scores)
+}
+
+// drawHeist adds the player's side and how the heist is going to the top
+// left of the heads up display.
+func drawHeist(hud *Hud, line func(string, [3]float32)) {
+	heist := hud.heist
+	line(common.TeamNames[hud.team], white)
+	line("Loot "+strconv.Itoa(heist.Escaped)+"/"+strconv.Itoa(heist.Required)+" out, "+
+		strconv.Itoa(len(heist.Loot))+" left", lootColor)
+	if heist.Carrying > 0 {
+		line("Carrying "+strconv.Itoa(heist.Carrying), lootColor)
+	}
+	line("Wins: Thieves "+strconv.Itoa(heist.Wins[common.TeamThieves])+
+		", Guards "+strconv.Itoa(heist.Wins[common.TeamGuards]), white)
+}
+
+// drawRound shows the phase of the round and its timer at the top in the
+// middle, and the results of the last round in the middle of the screen
+// while they are up.
+func drawRound(draw Renderer, ops *OutputState, scores []common.Score) {
+	round := ops.hud.round
+	seconds := (round.TimeLeft + common.TickRate - 1) / common.TickRate
+	number := strconv.Itoa(round.Number)
+	var banner string
+	switch round.Phase {
+	case common.PhaseWaiting:
+		banner = "Waiting for more players"
+	case common.PhaseCountdown:
+		banner = "Round " + number + " starts in " + strconv.Itoa(seconds)
+	case common.PhasePlay:
+		banner = "Round " + number + "  " + strconv.Itoa(seconds/60) + ":" + padZero(seconds%60)
+	case common.PhaseResults:
+		banner = "Next round in " + strconv.Itoa(seconds)
+	}
+	centeredText(draw, ops, hudMargin, banner, white)
+	if round.Phase != common.PhaseResults {
+		return
+	}
+
+	lines := []string{pad("Round "+number, resultsWidth-18) + "  Tags  Loot Tagged"}
+	for _, score := range scores {
+		lines = append(lines, pad(score.Name, resultsWidth-18)+padLeft(strconv.Itoa(score.Tags), 6)+
+			padLeft(strconv.Itoa(score.Loot), 6)+padLeft(strconv.Itoa(score.Tagged), 7))
+	}
+	y := ops.screenBounds[1]/2 - float32(len(lines)+2)*lineHeight/2
+	centeredText(draw, ops, y, round.Result, playerDotColor)
+	y += 2 * lineHeight
+	for i, text := range lines {
+		color := white
+		if i > 0 && scores[i-1].Id == ops.hud.id {
+			color = playerDotColor
+		}
+		centeredText(draw, ops, y, text, color)
+		y += lineHeight
+	}
+}
+
+// Results lines are this many characters wide, fitting the longest name and
+// the stats.
+const resultsWidth = 16 + 2 + 18
+
+func centeredText(draw Renderer, ops *OutputState, y float32, text string, color [3]float32) {
+	x := ops.screenBounds[0]/2 - float32(raster.TextWidth(text)*textScale)/2
+	shadowedText(draw, [2]float32{x, y}, text, color)
+}
+
+func padZero(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+// points is what a player has scored: a point per tag, and one per loot
+// escaped with.
+func points(score common.Score) int {
+	return score.Tags + score.Loot
+}
+
+// The stamina bar is this many characters long
+const staminaBarLength = 10
+
+func staminaBar(stamina common.Stamina) string {
+	full := int(stamina.Left / common.MaxStamina * staminaBarLength)
+	return strings.Repeat("#", full) + strings.Repeat("-", staminaBarLength-full)
+}
+
+// staminaColor is white, or red while too tired to start sprinting.
+func staminaColor(stamina common.Stamina) [3]float32 {
+	if !stamina.CanSprint(true) {
+		return stateColors[common.PlayerIt]
+	}
+	return white
+}
+
+// The minimap fits in a square this many pixels wide
+const minimapSize = 180
+
+var playerDotColor = [3]float32{1, 0.9, 0.3}
+
+// minimapLayout returns the top left corner of the minimap on screen, in
+// the bottom right corner, and its pixels per tile, fitting a map of any
+// shape.
+func minimapLayout(screenBounds [2]float32, width, height int) ([2]float32, float32) {
+	pixelsPerTile := float32(math.Min(minimapSize/float64(width), minimapSize/float64(height)))
+	return [2]float32{
+		screenBounds[0] - hudMargin - float32(width)*pixelsPerTile,
+		screenBounds[1] - hudMargin - float32(height)*pixelsPerTile,
+	}, pixelsPerTile
+}
+
+// minimapDot marks a player on the minimap.
+type minimapDot struct {
+	position [2]float32
+	color    [3]float32
+}
+
+// rect returns the top left corner and width of the dot on a minimap laid
+// out by minimapLayout.
+func (dot minimapDot) rect(corner [2]float32, pixelsPerTile float32, mapHeight int) ([2]float32, float32) {
+	size := float32(math.Max(4, float64(pixelsPerTile)*1.5))
+	return [2]float32{
+		corner[0] + (dot.position[0]+0.5)*pixelsPerTile - size/2,
+		corner[1] + (float32(mapHeight)-dot.position[1]-0.5)*pixelsPerTile - size/2,
+	}, size
+}
+
+// Scoreboard lines are this many characters wide, fitting the longest
+// name, the marker and the tags.
+const scoreWidth = 2 + 16 + 1 + 4
+
+// drawLabel draws text centered just above a world position.
+func drawLabel(draw Renderer, position [2]float32, text string, color [3]float32) {
+	screen := draw.toScreen([2]float32{position[0], position[1] + 0.6})
+	screen[0] -= float32(raster.TextWidth(text)*textScale) / 2
+	screen[1] -= float32(raster.GlyphHeight * textScale)
+	shadowedText(draw, screen, text, color)
+}
+
+// shadowedText draws text with a dark drop shadow, to stay readable on any
+// background.
+func shadowedText(draw Renderer, position [2]float32, text string, color [3]float32) {
+	draw.text([2]float32{position[0] + textScale, position[1] + textScale}, text, [3]float32{0, 0, 0})
+	draw.text(position, text, color)
+}
+
+func pad(text string, width int) string {
+	if len(text) >= width {
+		return text[:width]
+	}
+	return text + strings.Repeat(" ", width-len(text))
+}
+
+func padLeft(text string, width int) string {
+	if len(text) >= width {
+		return text
+	}
+	return strings.Repeat(" ", width-len(text)) + text
+}
+
+// byPoints sorts the most points first, and then by id.
+type byPoints []common.Score
+
+func (s byPoints) Len() int      { return len(s) }
+func (s byPoints) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPoints) Less(i, j int) bool {
+	if points(s[i]) != points(s[j]) {
+		return points(s[i]) > points(s[j])
+	}
+	return s[i].Id < s[j].Id
+}
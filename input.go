@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"github.com/Laremere/sdl2"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+type Action int
+
+const (
+	ActionMoveUp Action = iota
+	ActionMoveDown
+	ActionMoveLeft
+	ActionMoveRight
+	ActionInteract
+	ActionSprint
+	ActionFullscreen
+	ActionZoomIn
+	ActionZoomOut
+	ActionScreenshot
+	ActionMinimap
+	// Analog actions, bound to controller axes
+	ActionMoveX
+	ActionMoveY
+	ActionAimX
+	ActionAimY
+)
+
+var actionNames = map[string]Action{
+	"moveUp":     ActionMoveUp,
+	"moveDown":   ActionMoveDown,
+	"moveLeft":   ActionMoveLeft,
+	"moveRight":  ActionMoveRight,
+	"interact":   ActionInteract,
+	"sprint":     ActionSprint,
+	"fullscreen": ActionFullscreen,
+	"zoomIn":     ActionZoomIn,
+	"zoomOut":    ActionZoomOut,
+	"screenshot": ActionScreenshot,
+	"minimap":    ActionMinimap,
+	"moveX":      ActionMoveX,
+	"moveY":      ActionMoveY,
+	"aimX":       ActionAimX,
+	"aimY":       ActionAimY,
+}
+
+// Bindings maps input names to the action they trigger. Keys use their SDL
+// names, controller buttons and axes use their SDL names prefixed by "pad:".
+type Bindings map[string]Action
+
+const padPrefix = "pad:"
+
+var defaultBindings = `
+moveUp: W, Up, pad:dpup
+moveDown: S, Down, pad:dpdown
+moveLeft: A, Left, pad:dpleft
+moveRight: D, Right, pad:dpright
+interact: E, pad:a
+sprint: Left Shift, pad:leftshoulder
+fullscreen: F11
+zoomIn: =, Keypad +
+zoomOut: -, Keypad -
+screenshot: F12
+minimap: M, pad:back
+moveX: pad:leftx
+moveY: pad:lefty
+aimX: pad:rightx
+aimY: pad:righty
+`
+
+// LoadBindings reads a bindings file with one action per line, followed by
+// a colon and a comma separated list of inputs. The defaults are used when
+// the file doesn't exist.
+func LoadBindings(filename string) (Bindings, error) {
+	bindingBytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ParseBindings(defaultBindings)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseBindings(string(bindingBytes))
+}
+
+func ParseBindings(bindingString string) (Bindings, error) {
+	bindings := make(Bindings)
+	for _, line := range strings.Split(bindingString, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid binding: " + line)
+		}
+		action, ok := actionNames[strings.TrimSpace(parts[0])]
+		if !ok {
+			return nil, errors.New("Unknown action: " + parts[0])
+		}
+		for _, input := range strings.Split(parts[1], ",") {
+			input = strings.TrimSpace(input)
+			if input != "" {
+				bindings[input] = action
+			}
+		}
+	}
+	return bindings, nil
+}
+
+// Input turns keyboard, mouse and controller events into an InputState.
+type Input struct {
+	bindings     Bindings
+	held         map[string]bool
+	pressed      map[Action]bool
+	axes         map[Action]float32
+	screenCenter [2]int
+	mouseAim     [2]float32
+	controllers  []*sdl.GameController
+}
+
+func NewInput(bindings Bindings, screenWidth, screenHeight int) *Input {
+	input := &Input{
+		bindings:     bindings,
+		held:         make(map[string]bool),
+		pressed:      make(map[Action]bool),
+		axes:         make(map[Action]float32),
+		screenCenter: [2]int{screenWidth / 2, screenHeight / 2},
+	}
+	for i := 0; i < sdl.NumJoysticks(); i++ {
+		input.openController(i)
+	}
+	return input
+}
+
+func (input *Input) openController(index int) {
+	if !sdl.IsGameController(index) {
+		return
+	}
+	controller, err := sdl.GameControllerOpen(index)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	input.controllers = append(input.controllers, controller)
+}
+
+// handleEvent updates the input from an event, and reports whether the
+// event was an input event.
+func (input *Input) handleEvent(event sdl.Event) bool {
+	switch event := event.(type) {
+	case *sdl.MouseMoveEvent:
+		input.mouseAim = [2]float32{
+			float32(event.X - input.screenCenter[0]),
+			float32(input.screenCenter[1] - event.Y),
+		}
+	case *sdl.KeyupEvent:
+		input.release(event.Key)
+	case *sdl.KeydownEvent:
+		input.press(event.Key)
+	case *sdl.ControllerButtonUpEvent:
+		input.release(padPrefix + event.Button)
+	case *sdl.ControllerButtonDownEvent:
+		input.press(padPrefix + event.Button)
+	case *sdl.ControllerAxisEvent:
+		if action, ok := input.bindings[padPrefix+event.Axis]; ok {
+			input.axes[action] = float32(event.Value) / math.MaxInt16
+		}
+	case *sdl.ControllerDeviceAddedEvent:
+		input.openController(event.Which)
+	default:
+		return false
+	}
+	return true
+}
+
+func (input *Input) press(name string) {
+	if action, ok := input.bindings[name]; ok && !input.held[name] {
+		input.pressed[action] = true
+	}
+	input.held[name] = true
+}
+
+func (input *Input) release(name string) {
+	input.held[name] = false
+}
+
+// takePressed reports whether the action was pressed since the last time
+// it was taken.
+func (input *Input) takePressed(action Action) bool {
+	pressed := input.pressed[action]
+	input.pressed[action] = false
+	return pressed
+}
+
+func (input *Input) resize(screenWidth, screenHeight int) {
+	input.screenCenter = [2]int{screenWidth / 2, screenHeight / 2}
+}
+
+func (input *Input) actionHeld(action Action) bool {
+	for name, held := range input.held {
+		if bound, ok := input.bindings[name]; held && ok && bound == action {
+			return true
+		}
+	}
+	return false
+}
+
+// axis returns an analog action's value, with up as positive for the Y
+// axes, and zero inside the dead zone.
+func (input *Input) axis(action Action) float32 {
+	value := input.axes[action]
+	if action == ActionMoveY || action == ActionAimY {
+		value = -value
+	}
+	if value < stickDeadZone && value > -stickDeadZone {
+		return 0
+	}
+	return value
+}
+
+const stickDeadZone = 0.25
+
+// update fills in the InputState for the next tick. Digital movement wins
+// over the stick, and the right stick wins over the mouse.
+func (input *Input) update(ips *InputState) {
+	ips.direction = [2]float32{0, 0}
+	if input.actionHeld(ActionMoveLeft) {
+		ips.direction[0] -= 1
+	}
+	if input.actionHeld(ActionMoveRight) {
+		ips.direction[0] += 1
+	}
+	if input.actionHeld(ActionMoveUp) {
+		ips.direction[1] += 1
+	}
+	if input.actionHeld(ActionMoveDown) {
+		ips.direction[1] -= 1
+	}
+	if ips.direction[1]*ips.direction[0] != 0 {
+		ips.direction[0] *= 0.70710678118
+		ips.direction[1] *= 0.70710678118
+	}
+
+	if ips.direction == [2]float32{0, 0} {
+		ips.direction = [2]float32{input.axis(ActionMoveX), input.axis(ActionMoveY)}
+		length := float32(math.Hypot(float64(ips.direction[0]), float64(ips.direction[1])))
+		if length > 1 {
+			ips.direction[0] /= length
+			ips.direction[1] /= length
+		}
+	}
+
+	ips.aim = [2]float32{input.axis(ActionAimX), input.axis(ActionAimY)}
+	if ips.aim == [2]float32{0, 0} {
+		ips.aim = input.mouseAim
+	}
+
+	ips.sprint = input.actionHeld(ActionSprint)
+	// Stays set until a tick has seen it
+	if input.takePressed(ActionInteract) {
+		ips.interact = true
+	}
+}
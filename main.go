@@ -1,43 +1,83 @@
 package main
 
 import (
+	"flag"
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/line-of-sight/raster"
 	"github.com/Laremere/sdl2"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"runtime"
-	"strconv"
 	"time"
 )
 
+var keysFile = flag.String("keys", "keys.txt", "File to load key bindings from")
+var zoom = flag.Float64("zoom", 32, "Pixels per tile")
+var fullscreen = flag.Bool("fullscreen", false, "Start in fullscreen")
+var softShadows = flag.Bool("soft", false, "Blur shadow edges and fade sight out with distance")
+var mapFile = flag.String("map", "map.txt", "Map to play on")
+var minimapFog = flag.Bool("minimapFog", true, "Hide the parts of the map not yet explored on the minimap")
+var playerName = flag.String("name", "", "Name shown to other players")
+var atlasFile = flag.String("atlas", "atlas.txt", "Texture atlas manifest, or empty to draw everything procedurally")
+var renderFile = flag.String("render", "", "Render a single frame to this PNG file and exit, without connecting")
+var software = flag.Bool("software", false, "Use the software renderer for -render, needing no GPU")
+var volume = flag.Float64("volume", 1, "Sound volume, or 0 for no sound")
+var renderAt = vec2Flag{5, 5}
+var renderFacing = vec2Flag{1, 0}
+
+func init() {
+	flag.Var(&renderAt, "at", "Viewer position for -render, as x,y")
+	flag.Var(&renderFacing, "facing", "Viewer facing direction for -render, as x,y")
+}
+
 func main() {
+	flag.Parse()
 	runtime.LockOSThread()
 
-	res, err := http.Get("http://vps.redig.us")
-	if err != nil {
-		log.Fatal(err)
-	}
-	ipAddrBytes, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Server IP:", string(ipAddrBytes))
-
 	screenWidth := 1280
 	screenHeight := 720
 
-	err = sdl.SdlInit()
+	if *software {
+		if *renderFile == "" {
+			log.Fatal("-software is only supported with -render")
+		}
+		renderer := NewSoftwareRenderer(screenWidth, screenHeight)
+		renderer.minimapFog = *minimapFog
+		renderer.setAtlas(loadAtlas())
+		err := renderToFile(renderer, screenWidth, screenHeight)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := sdl.SdlInit()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer sdl.Quit()
 
-	window, err := sdl.CreateWindow("Line Of Sight", 30, 30, screenWidth, screenHeight, sdl.WindowShown|sdl.WindowOpengl)
+	// Only the core profile is used, so drivers without the compatibility
+	// profile work too
+	sdl.GlSetAttribute(sdl.GlContextMajorVersion, 3)
+	sdl.GlSetAttribute(sdl.GlContextMinorVersion, 2)
+	sdl.GlSetAttribute(sdl.GlContextProfileMask, sdl.GlContextProfileCore)
+
+	windowFlags := sdl.WindowShown | sdl.WindowOpengl | sdl.WindowResizable
+	if *renderFile != "" {
+		windowFlags = sdl.WindowHidden | sdl.WindowOpengl
+	}
+	window, err := sdl.CreateWindow("Line Of Sight", 30, 30, screenWidth, screenHeight, windowFlags)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer window.Close()
+	isFullscreen := *fullscreen
+	if isFullscreen {
+		window.SetFullscreen(true)
+	}
 
 	context, err := window.CreateContext()
 	if err != nil {
@@ -49,51 +89,68 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	draw.soft = *softShadows
+	draw.minimapFog = *minimapFog
+	draw.setAtlas(loadAtlas())
+
+	if *renderFile != "" {
+		err = renderToFile(draw, screenWidth, screenHeight)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	mapBytes, err := ioutil.ReadFile("map.txt")
+	gameMap, err := common.LoadMap(*mapFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	mapString := string(mapBytes)
-
-	scene := newScene(50, 50)
-
-	k := 0
-	for j := 0; j < 50; j++ {
-		for i := 0; i < 50; i++ {
-			mapItem := int64(-1)
-			for mapItem < 0 {
-				token := string(mapString[k])
-				mapItem, err = strconv.ParseInt(token, 10, 32)
-				if err != nil {
-					mapItem = -1
-				}
-				k++
-			}
-			scene.setWall(i, 49-j, Wall(mapItem))
-			// if i == 0 || i == 49 ||
-			// 	j == 0 || j == 49 ||
-			// 	(j%4 == 0 && i%4 == 0) {
-			// 	scene.setWall(i, j, WallStone)
-			// } else {
-			// 	scene.setWall(i, j, WallNone)
-			// }
-		}
-	}
+	scene := newScene(gameMap)
 
 	draw.generateWalls(scene)
 
+	res, err := http.Get("http://vps.redig.us")
+	if err != nil {
+		log.Fatal(err)
+	}
+	ipAddrBytes, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server IP:", string(ipAddrBytes))
+
 	player := NewPlayer()
 	scene.entities = append(scene.entities, player)
-	scene.entities = append(scene.entities, newServerConn(string(ipAddrBytes), player))
+	audio := openAudio(float32(*volume))
+	defer audio.close()
+	scene.entities = append(scene.entities, newServerConn(string(ipAddrBytes), *playerName, player, audio))
+
+	bindings, err := LoadBindings(*keysFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	input := NewInput(bindings, screenWidth, screenHeight)
 
 	var inputState InputState
-	inputState.keydown = make(map[string]bool)
 	var outputState OutputState
 	outputState.screenBounds[0] = float32(screenWidth)
 	outputState.screenBounds[1] = float32(screenHeight)
+	outputState.pixelsPerTile = float32(*zoom)
+	outputState.vision = common.DefaultVision
+	outputState.minimap = true
+	tick := time.Second / common.TickRate
+	previousTime := time.Now()
+	var accumulator time.Duration
 	for running := true; running; {
-		EndTime := time.Now().Add(time.Second / 60)
+		now := time.Now()
+		frameEnd := now.Add(time.Second / maxFrameRate)
+		accumulator += now.Sub(previousTime)
+		previousTime = now
+		// Drop time rather than spiral when the simulation can't keep up
+		if accumulator > maxTicksPerFrame*tick {
+			accumulator = maxTicksPerFrame * tick
+		}
 
 		for {
 			event := sdl.PollEvent()
@@ -101,44 +158,83 @@ func main() {
 				break
 			}
 
+			if input.handleEvent(event) {
+				continue
+			}
 			switch event := event.(type) {
 			case *sdl.QuitEvent:
 				running = false
-			case *sdl.MouseMoveEvent:
-			case *sdl.KeyupEvent:
-				inputState.keydown[event.Key] = false
-			case *sdl.KeydownEvent:
-				inputState.keydown[event.Key] = true
+			case *sdl.WindowResizedEvent:
+				draw.resize(event.Width, event.Height)
+				input.resize(event.Width, event.Height)
+				outputState.screenBounds[0] = float32(event.Width)
+				outputState.screenBounds[1] = float32(event.Height)
 			default:
 				//log.Println("Unkown event:", reflect.ValueOf(event).Type().Name(), event)
 			}
 		}
+		input.update(&inputState)
 
-		inputState.direction = [2]float32{0, 0}
-		if inputState.keydown["A"] {
-			inputState.direction[0] -= 1
+		if input.takePressed(ActionFullscreen) {
+			isFullscreen = !isFullscreen
+			window.SetFullscreen(isFullscreen)
 		}
-		if inputState.keydown["D"] {
-			inputState.direction[0] += 1
+		takeScreenshot := input.takePressed(ActionScreenshot)
+		if input.takePressed(ActionMinimap) {
+			outputState.minimap = !outputState.minimap
 		}
-		if inputState.keydown["W"] {
-			inputState.direction[1] += 1
+		if input.takePressed(ActionZoomIn) && outputState.pixelsPerTile < maxZoom {
+			outputState.pixelsPerTile *= zoomStep
 		}
-		if inputState.keydown["S"] {
-			inputState.direction[1] -= 1
-		}
-		if inputState.direction[1]*inputState.direction[0] != 0 {
-			inputState.direction[0] *= 0.70710678118
-			inputState.direction[1] *= 0.70710678118
+		if input.takePressed(ActionZoomOut) && outputState.pixelsPerTile > minZoom {
+			outputState.pixelsPerTile /= zoomStep
 		}
 
-		for _, entity := range scene.entities {
-			entity.step(scene, &inputState, &outputState)
+		for ; accumulator >= tick; accumulator -= tick {
+			outputState.lights = scene.lampLights()
+			for _, entity := range scene.entities {
+				entity.step(scene, &inputState, &outputState)
+			}
+			inputState.interact = false
 		}
 
+		audio.update()
+
+		outputState.alpha = float32(accumulator) / float32(tick)
+		outputState.screenCenter = player.interpolatedPosition(outputState.alpha)
+
 		draw.draw(scene, &outputState)
+		// The frame just drawn is still in the back buffer
+		if takeScreenshot {
+			filename := "screenshot-" + time.Now().Format("20060102-150405") + ".png"
+			err = savePNG(filename, draw.readPixels())
+			if err != nil {
+				log.Println(err)
+			} else {
+				log.Println("Saved", filename)
+			}
+		}
 		window.GlSwap()
-		//time.Sleep(time.Second / 30)
-		time.Sleep(EndTime.Sub(time.Now()))
+		time.Sleep(frameEnd.Sub(time.Now()))
+	}
+}
+
+// loadAtlas loads the -atlas manifest, falling back to procedural drawing
+// when it doesn't exist.
+func loadAtlas() *raster.Atlas {
+	atlas, err := raster.LoadAtlas(*atlasFile)
+	if os.IsNotExist(err) {
+		return nil
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return atlas
 }
+
+const maxFrameRate = 144
+const maxTicksPerFrame = 5
+
+const minZoom = 8
+const maxZoom = 128
+const zoomStep = 1.25
@@ -0,0 +1,50 @@
+package main
+
+// matrix is a 4x4 matrix in the column major order OpenGL expects.
+type matrix [16]float32
+
+func identity() matrix {
+	return matrix{
+		1, 0, 0, 0,
+		0, 1, 0, 0,
+		0, 0, 1, 0,
+		0, 0, 0, 1,
+	}
+}
+
+func ortho(left, right, bottom, top float32) matrix {
+	m := identity()
+	m[0] = 2 / (right - left)
+	m[5] = 2 / (top - bottom)
+	m[12] = -(right + left) / (right - left)
+	m[13] = -(top + bottom) / (top - bottom)
+	return m
+}
+
+func translate(x, y float32) matrix {
+	m := identity()
+	m[12] = x
+	m[13] = y
+	return m
+}
+
+func scale(x, y float32) matrix {
+	m := identity()
+	m[0] = x
+	m[5] = y
+	return m
+}
+
+func (a matrix) mul(b matrix) matrix {
+	var m matrix
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			var sum float32
+			for k := 0; k < 4; k++ {
+				sum += a[k*4+row] * b[col*4+k]
+			}
+			m[col*4+row] = sum
+		}
+	}
+	return m
+}
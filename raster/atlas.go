@@ -0,0 +1,186 @@
+package raster
+
+import (
+	"errors"
+	"github.com/Laremere/line-of-sight/common"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Atlas is every tile and sprite image packed into one image, as a grid of
+// square cells. Cells are given as their column and row, counting from the
+// top left.
+type Atlas struct {
+	Image    *image.NRGBA
+	CellSize int
+	Walls    map[common.Wall][2]int
+	Players  map[common.PlayerState][2]int
+}
+
+var wallNames = map[string]common.Wall{
+	"floor":    common.WallNone,
+	"stone":    common.WallStone,
+	"door":     common.WallDoor,
+	"doorOpen": common.WallDoorOpen,
+	"crate":    common.WallCrate,
+}
+
+var stateNames = map[string]common.PlayerState{
+	"run":        common.PlayerRun,
+	"it":         common.PlayerIt,
+	"invincible": common.PlayerInvincible,
+	"caught":     common.PlayerCaught,
+}
+
+// LoadAtlas reads an atlas manifest, with one entry per line: the image
+// file relative to the manifest, the cell size in pixels, and then the
+// cell of every tile and player state.
+func LoadAtlas(filename string) (*Atlas, error) {
+	manifestBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	atlas, imageFile, err := ParseAtlas(string(manifestBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(filepath.Dir(filename), imageFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	atlas.Image = image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(atlas.Image, atlas.Image.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	used := make([][2]int, 0, len(atlas.Walls)+len(atlas.Players))
+	for _, cell := range atlas.Walls {
+		used = append(used, cell)
+	}
+	for _, cell := range atlas.Players {
+		used = append(used, cell)
+	}
+	cells := atlas.Cells()
+	for _, cell := range used {
+		if float32(cell[0]) >= cells[0] || float32(cell[1]) >= cells[1] {
+			return nil, errors.New("Atlas cell outside of image: " + strconv.Itoa(cell[0]) + ", " + strconv.Itoa(cell[1]))
+		}
+	}
+	return atlas, nil
+}
+
+// ParseAtlas reads an atlas manifest, returning the atlas without its image
+// and the image's filename.
+func ParseAtlas(manifest string) (*Atlas, string, error) {
+	atlas := &Atlas{
+		Walls:   make(map[common.Wall][2]int),
+		Players: make(map[common.PlayerState][2]int),
+	}
+	imageFile := ""
+	for _, line := range strings.Split(manifest, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, "", errors.New("Invalid atlas entry: " + line)
+		}
+		name := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		switch name {
+		case "image":
+			imageFile = value
+			continue
+		case "cell":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				return nil, "", errors.New("Invalid atlas cell size: " + value)
+			}
+			atlas.CellSize = size
+			continue
+		}
+
+		cell, err := parseCell(value)
+		if err != nil {
+			return nil, "", err
+		}
+		if wall, ok := wallNames[name]; ok {
+			atlas.Walls[wall] = cell
+		} else if state, ok := stateNames[name]; ok {
+			atlas.Players[state] = cell
+		} else {
+			return nil, "", errors.New("Unknown atlas entry: " + name)
+		}
+	}
+
+	if imageFile == "" {
+		return nil, "", errors.New("Atlas has no image")
+	}
+	if atlas.CellSize == 0 {
+		return nil, "", errors.New("Atlas has no cell size")
+	}
+	for name, wall := range wallNames {
+		if _, ok := atlas.Walls[wall]; !ok {
+			return nil, "", errors.New("Missing atlas entry: " + name)
+		}
+	}
+	for name, state := range stateNames {
+		if _, ok := atlas.Players[state]; !ok {
+			return nil, "", errors.New("Missing atlas entry: " + name)
+		}
+	}
+	return atlas, imageFile, nil
+}
+
+func parseCell(value string) ([2]int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return [2]int{}, errors.New("Invalid atlas cell: " + value)
+	}
+	var cell [2]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return [2]int{}, errors.New("Invalid atlas cell: " + value)
+		}
+		cell[i] = n
+	}
+	return cell, nil
+}
+
+// Cells returns how many cells the atlas image is across and down.
+func (atlas *Atlas) Cells() [2]float32 {
+	return [2]float32{
+		float32(atlas.Image.Bounds().Dx() / atlas.CellSize),
+		float32(atlas.Image.Bounds().Dy() / atlas.CellSize),
+	}
+}
+
+// Sample returns the color and alpha of a cell at local, which runs from 0
+// to 1 left to right and bottom to top.
+func (atlas *Atlas) Sample(cell [2]int, local [2]float32) ([3]float32, float32) {
+	x := cell[0]*atlas.CellSize + clampInt(int(local[0]*float32(atlas.CellSize)), 0, atlas.CellSize-1)
+	y := cell[1]*atlas.CellSize + clampInt(int((1-local[1])*float32(atlas.CellSize)), 0, atlas.CellSize-1)
+	texel := atlas.Image.NRGBAAt(x, y)
+	return [3]float32{
+		float32(texel.R) / 255,
+		float32(texel.G) / 255,
+		float32(texel.B) / 255,
+	}, float32(texel.A) / 255
+}
+
+func clampInt(value, low, high int) int {
+	return max(low, min(value, high))
+}
@@ -0,0 +1,67 @@
+package raster
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"math"
+)
+
+// Texels per tile in the explored mask, shared with the OpenGL renderer's
+// explored texture.
+const ExploredResolution = 4
+
+// Explored remembers which parts of a map have been in sight.
+type Explored struct {
+	width, height int
+	seen          []float32
+}
+
+func NewExplored(m *common.Map) *Explored {
+	width, height := m.Width*ExploredResolution, m.Height*ExploredResolution
+	return &Explored{width, height, make([]float32, width*height)}
+}
+
+// Add marks everything canvas shows in sight as explored.
+func (explored *Explored) Add(canvas *Canvas) {
+	for y := 0; y < explored.height; y++ {
+		for x := 0; x < explored.width; x++ {
+			px, py := canvas.Camera.Pixel([2]float32{
+				(float32(x)+0.5)/ExploredResolution - 0.5,
+				(float32(y)+0.5)/ExploredResolution - 0.5,
+			})
+			if px < 0 || py < 0 || px >= canvas.Camera.Width || py >= canvas.Camera.Height {
+				continue
+			}
+			if canvas.shadow[px+py*canvas.Camera.Width] < 0.5 {
+				explored.seen[x+y*explored.width] = 1
+			}
+		}
+	}
+}
+
+// At returns how explored position is, blended between the nearest texels
+// as the OpenGL renderer's linear filtering does.
+func (explored *Explored) At(position [2]float32) float32 {
+	u := float64(position[0]+0.5)*ExploredResolution - 0.5
+	v := float64(position[1]+0.5)*ExploredResolution - 0.5
+	left, top := math.Floor(u), math.Floor(v)
+	fx, fy := float32(u-left), float32(v-top)
+	x, y := int(left), int(top)
+	above := explored.texel(x, y)*(1-fx) + explored.texel(x+1, y)*fx
+	below := explored.texel(x, y+1)*(1-fx) + explored.texel(x+1, y+1)*fx
+	return above*(1-fy) + below*fy
+}
+
+// texel clamps to the edge of the map, like the explored texture.
+func (explored *Explored) texel(x, y int) float32 {
+	x = min(max(x, 0), explored.width-1)
+	y = min(max(y, 0), explored.height-1)
+	return explored.seen[x+y*explored.width]
+}
+
+// seen returns how explored position is, or 1 with no explored mask.
+func (canvas *Canvas) seen(position [2]float32) float32 {
+	if canvas.Explored == nil {
+		return 1
+	}
+	return canvas.Explored.At(position)
+}
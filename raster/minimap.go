@@ -0,0 +1,55 @@
+package raster
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+)
+
+// MinimapColor is how a tile shows on the minimap, shared with the OpenGL
+// renderer.
+func MinimapColor(wall common.Wall) [3]float32 {
+	switch {
+	case wall == common.WallDoorOpen:
+		return [3]float32{0.3, 0.22, 0.12}
+	case wall.Solid():
+		tint := WallTints[wall]
+		return [3]float32{0.45 * tint[0], 0.45 * tint[1], 0.45 * tint[2]}
+	}
+	return [3]float32{0.12, 0.12, 0.12}
+}
+
+// Minimap draws the whole map with its top left corner at the pixel left,
+// top, each tile pixelsPerTile pixels wide. With fog set, what hasn't been
+// explored is dimmed.
+func (canvas *Canvas) Minimap(m *common.Map, left, top int, pixelsPerTile float32, fog bool) {
+	width := int(float32(m.Width) * pixelsPerTile)
+	height := int(float32(m.Height) * pixelsPerTile)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			tileX := int(float32(x) / pixelsPerTile)
+			tileY := m.Height - 1 - int(float32(y)/pixelsPerTile)
+			tileColor := MinimapColor(m.Get(tileX, tileY))
+			if fog {
+				position := [2]float32{
+					(float32(x)+0.5)/float32(width)*float32(m.Width) - 0.5,
+					(1-(float32(y)+0.5)/float32(height))*float32(m.Height) - 0.5,
+				}
+				dim := minimapFog + (1-minimapFog)*canvas.seen(position)
+				tileColor = [3]float32{tileColor[0] * dim, tileColor[1] * dim, tileColor[2] * dim}
+			}
+			canvas.Image.SetRGBA(left+x, top+y, toRGBA(tileColor))
+		}
+	}
+}
+
+// Unexplored tiles on the minimap are dimmed to this much of their color
+const minimapFog = 0.15
+
+// Rect fills a rectangle of pixels with its top left corner at left, top.
+func (canvas *Canvas) Rect(left, top, width, height int, rectColor [3]float32) {
+	c := toRGBA(rectColor)
+	for y := top; y < top+height; y++ {
+		for x := left; x < left+width; x++ {
+			canvas.Image.SetRGBA(x, y, c)
+		}
+	}
+}
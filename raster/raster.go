@@ -0,0 +1,314 @@
+// Package raster draws the line of sight view in pure Go, without a GPU,
+// following what the client's OpenGL shaders do.
+package raster
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"image"
+	"image/color"
+	"math"
+)
+
+// WallTints colors each kind of solid tile, shared with the OpenGL renderer.
+var WallTints = map[common.Wall][3]float32{
+	common.WallStone: [3]float32{1.0, 1.0, 1.0},
+	common.WallDoor:  [3]float32{1.6, 1.1, 0.6},
+	common.WallCrate: [3]float32{1.3, 1.2, 0.8},
+}
+
+// Camera is the part of the world shown, centered on Center.
+type Camera struct {
+	Center        [2]float32
+	PixelsPerTile float32
+	Width, Height int
+}
+
+// World returns the world position of the center of a pixel.
+func (camera Camera) World(x, y int) [2]float32 {
+	return [2]float32{
+		camera.Center[0] + (float32(x)+0.5-float32(camera.Width)/2)/camera.PixelsPerTile,
+		camera.Center[1] + (float32(camera.Height)/2-float32(y)-0.5)/camera.PixelsPerTile,
+	}
+}
+
+// Pixel returns the pixel containing a world position.
+func (camera Camera) Pixel(position [2]float32) (int, int) {
+	x := (position[0]-camera.Center[0])*camera.PixelsPerTile + float32(camera.Width)/2
+	y := float32(camera.Height)/2 - (position[1]-camera.Center[1])*camera.PixelsPerTile
+	return int(math.Floor(float64(x))), int(math.Floor(float64(y)))
+}
+
+type Canvas struct {
+	Camera Camera
+	Image  *image.RGBA
+	// Textures for tiles and sprites, or nil to draw them procedurally
+	Atlas *Atlas
+	// What has been in sight, or nil when everything has
+	Explored *Explored
+	// How shadowed each pixel is, from 0 for in sight to 1
+	shadow []float32
+	// How lit each pixel is, from 0 for dark to 1
+	light []float32
+}
+
+// NewCanvas creates a canvas with everything in sight and fully lit.
+func NewCanvas(camera Camera) *Canvas {
+	light := make([]float32, camera.Width*camera.Height)
+	for i := range light {
+		light[i] = 1
+	}
+	return &Canvas{
+		Camera: camera,
+		Image:  image.NewRGBA(image.Rect(0, 0, camera.Width, camera.Height)),
+		shadow: make([]float32, camera.Width*camera.Height),
+		light:  light,
+	}
+}
+
+// Shadow hides every pixel none of the viewers can see. A pixel is hidden
+// from a viewer when the line to it crosses a solid tile, which is exactly
+// the area the OpenGL renderer's shadow volumes cover, or when it is
+// outside their vision cone.
+func (canvas *Canvas) Shadow(m *common.Map, viewers []common.Viewer, vision common.Vision) {
+	for y := 0; y < canvas.Camera.Height; y++ {
+		for x := 0; x < canvas.Camera.Width; x++ {
+			if !vision.Sees(m, viewers, canvas.Camera.World(x, y)) {
+				canvas.shadow[x+y*canvas.Camera.Width] = 1
+			}
+		}
+	}
+}
+
+// Light replaces full lighting with the light cast by lights. Light is
+// only worked out where Shadow has left something in sight, since it
+// doesn't show anywhere else.
+func (canvas *Canvas) Light(m *common.Map, lights []common.Light) {
+	for y := 0; y < canvas.Camera.Height; y++ {
+		for x := 0; x < canvas.Camera.Width; x++ {
+			i := x + y*canvas.Camera.Width
+			if canvas.shadow[i] >= 1 {
+				canvas.light[i] = 0
+				continue
+			}
+			canvas.light[i] = common.Lit(m, lights, canvas.Camera.World(x, y))
+		}
+	}
+}
+
+// Background draws the floor, brighter the more it is lit where in sight,
+// as noise where it has been seen before, and dark where it never has.
+func (canvas *Canvas) Background() {
+	for y := 0; y < canvas.Camera.Height; y++ {
+		for x := 0; x < canvas.Camera.Width; x++ {
+			i := x + y*canvas.Camera.Width
+			position := canvas.Camera.World(x, y)
+			if canvas.shadow[i] < 0.5 {
+				shade := mix(UnlitFloor, LitFloor, canvas.light[i])
+				if canvas.Atlas != nil {
+					// A fully lit floor texture is shown as drawn
+					texel, _ := canvas.Atlas.Sample(canvas.Atlas.Walls[common.WallNone], tileLocal(position))
+					shade = [3]float32{
+						texel[0] * shade[0] / LitFloor[0],
+						texel[1] * shade[1] / LitFloor[1],
+						texel[2] * shade[2] / LitFloor[2],
+					}
+				}
+				canvas.Image.SetRGBA(x, y, toRGBA(shade))
+				continue
+			}
+			noise := rand(float32(math.Floor(float64(position[0]*5))), float32(math.Floor(float64(position[1]*10))))
+			gray := float32(math.Floor(float64(noise)+0.5))/40 + 0.1
+			memory := mix(unseenFloor, [3]float32{gray, gray, gray}, canvas.seen(position))
+			canvas.Image.SetRGBA(x, y, toRGBA(memory))
+		}
+	}
+}
+
+// UnlitFloor and LitFloor are the colors of floor in sight, from dark to
+// fully lit.
+var UnlitFloor = [3]float32{0.35, 0.35, 0.35}
+var LitFloor = [3]float32{0.75, 0.72, 0.65}
+
+var unseenFloor = [3]float32{0.02, 0.02, 0.02}
+
+// Walls never seen are dimmed to this much of their color
+const unseenWall = 0.1
+
+// Walls draws every solid tile, striped and outlined where it borders open
+// floor, or from the atlas along with open doors, dimmed where never seen.
+func (canvas *Canvas) Walls(m *common.Map) {
+	for y := 0; y < canvas.Camera.Height; y++ {
+		for x := 0; x < canvas.Camera.Width; x++ {
+			position := canvas.Camera.World(x, y)
+			tileX := int(math.Floor(float64(position[0] + 0.5)))
+			tileY := int(math.Floor(float64(position[1] + 0.5)))
+			wall := m.Get(tileX, tileY)
+			if tileX < 0 || tileY < 0 || tileX >= m.Width || tileY >= m.Height {
+				continue
+			}
+			dim := unseenWall + (1-unseenWall)*canvas.seen(position)
+			if canvas.Atlas != nil {
+				if wall != common.WallNone {
+					texel, alpha := canvas.Atlas.Sample(canvas.Atlas.Walls[wall], tileLocal(position))
+					texel = [3]float32{texel[0] * dim, texel[1] * dim, texel[2] * dim}
+					canvas.Image.SetRGBA(x, y, blend(canvas.Image.RGBAAt(x, y), texel, alpha))
+				}
+				continue
+			}
+			if !wall.Solid() {
+				continue
+			}
+
+			localX := position[0] - float32(tileX)
+			localY := position[1] - float32(tileY)
+			gray := 0.1 + float32(math.Max(0, math.Min(1, math.Sin(float64(localX-localY)*12.5663706144))))/5
+			open := func(dx, dy int) bool {
+				return !m.Get(tileX+dx, tileY+dy).Solid()
+			}
+			if (localX < -0.3 && open(-1, 0)) || (localX > 0.3 && open(1, 0)) ||
+				(localY < -0.3 && open(0, -1)) || (localY > 0.3 && open(0, 1)) ||
+				(localX > 0.3 && localY > 0.3 && open(1, 1)) ||
+				(localX < -0.3 && localY > 0.3 && open(-1, 1)) ||
+				(localX > 0.3 && localY < -0.3 && open(1, -1)) ||
+				(localX < -0.3 && localY < -0.3 && open(-1, -1)) {
+				gray = 0.3
+			}
+
+			tint := WallTints[wall]
+			canvas.Image.SetRGBA(x, y, toRGBA([3]float32{gray * tint[0] * dim, gray * tint[1] * dim, gray * tint[2] * dim}))
+		}
+	}
+}
+
+// Quad draws a square size tiles wide centered on position, blended with
+// alpha. Unless ignoreShadow is set it is hidden where out of sight or too
+// dark to see.
+func (canvas *Canvas) Quad(position [2]float32, size float32, quadColor [3]float32, alpha float32, ignoreShadow bool) {
+	canvas.fill(position, [2]float32{size, size}, ignoreShadow, func(local [2]float32) ([3]float32, float32) {
+		return quadColor, alpha
+	})
+}
+
+// Box draws a rectangle size tiles across centered on position, hidden like
+// Quad.
+func (canvas *Canvas) Box(position, size [2]float32, boxColor [3]float32, alpha float32, ignoreShadow bool) {
+	canvas.fill(position, size, ignoreShadow, func(local [2]float32) ([3]float32, float32) {
+		return boxColor, alpha
+	})
+}
+
+// Sprite draws an atlas cell like Quad, taking the color from the atlas.
+func (canvas *Canvas) Sprite(position [2]float32, size float32, cell [2]int, alpha float32, ignoreShadow bool) {
+	canvas.fill(position, [2]float32{size, size}, ignoreShadow, func(local [2]float32) ([3]float32, float32) {
+		texel, texelAlpha := canvas.Atlas.Sample(cell, local)
+		return texel, texelAlpha * alpha
+	})
+}
+
+// fill draws a rectangle like Box, asking shade for the color and alpha at
+// each point, given from 0 to 1 across the rectangle.
+func (canvas *Canvas) fill(position, size [2]float32, ignoreShadow bool, shade func(local [2]float32) ([3]float32, float32)) {
+	minX, maxY := canvas.Camera.Pixel([2]float32{position[0] - size[0]/2, position[1] - size[1]/2})
+	maxX, minY := canvas.Camera.Pixel([2]float32{position[0] + size[0]/2, position[1] + size[1]/2})
+	for y := max(minY, 0); y <= min(maxY, canvas.Camera.Height-1); y++ {
+		for x := max(minX, 0); x <= min(maxX, canvas.Camera.Width-1); x++ {
+			world := canvas.Camera.World(x, y)
+			if abs(world[0]-position[0]) > size[0]/2 || abs(world[1]-position[1]) > size[1]/2 {
+				continue
+			}
+			visible := float32(1)
+			if !ignoreShadow {
+				i := x + y*canvas.Camera.Width
+				visible -= canvas.shadow[i]
+				if visible <= 0 || canvas.light[i] < common.LitThreshold {
+					continue
+				}
+			}
+			quadColor, alpha := shade([2]float32{
+				(world[0]-position[0])/size[0] + 0.5,
+				(world[1]-position[1])/size[1] + 0.5,
+			})
+			canvas.Image.SetRGBA(x, y, blend(canvas.Image.RGBAAt(x, y), quadColor, alpha*visible))
+		}
+	}
+}
+
+// Preview draws a whole map, all in sight, at pixelsPerTile.
+func Preview(m *common.Map, pixelsPerTile float32) *image.RGBA {
+	canvas := NewCanvas(Camera{
+		[2]float32{float32(m.Width)/2 - 0.5, float32(m.Height)/2 - 0.5},
+		pixelsPerTile,
+		int(float32(m.Width) * pixelsPerTile),
+		int(float32(m.Height) * pixelsPerTile),
+	})
+	canvas.Background()
+	canvas.Walls(m)
+	return canvas.Image
+}
+
+// tileLocal returns where position is within its tile, from 0 to 1 left to
+// right and bottom to top.
+func tileLocal(position [2]float32) [2]float32 {
+	return [2]float32{
+		position[0] + 0.5 - float32(math.Floor(float64(position[0]+0.5))),
+		position[1] + 0.5 - float32(math.Floor(float64(position[1]+0.5))),
+	}
+}
+
+// rand is the same hash the background shader uses for its noise.
+func rand(x, y float32) float32 {
+	value := math.Sin(float64(x*12.9898+y*78.233)) * 43758.5453
+	return float32(value - math.Floor(value))
+}
+
+func mix(a, b [3]float32, amount float32) [3]float32 {
+	return [3]float32{
+		a[0] + (b[0]-a[0])*amount,
+		a[1] + (b[1]-a[1])*amount,
+		a[2] + (b[2]-a[2])*amount,
+	}
+}
+
+func toRGBA(c [3]float32) color.RGBA {
+	return color.RGBA{toByte(c[0]), toByte(c[1]), toByte(c[2]), 255}
+}
+
+func toByte(value float32) uint8 {
+	if value <= 0 {
+		return 0
+	}
+	if value >= 1 {
+		return 255
+	}
+	return uint8(value*255 + 0.5)
+}
+
+func blend(dst color.RGBA, src [3]float32, alpha float32) color.RGBA {
+	return color.RGBA{
+		toByte(float32(dst.R)/255*(1-alpha) + src[0]*alpha),
+		toByte(float32(dst.G)/255*(1-alpha) + src[1]*alpha),
+		toByte(float32(dst.B)/255*(1-alpha) + src[2]*alpha),
+		255,
+	}
+}
+
+func abs(value float32) float32 {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,180 @@
+package raster
+
+import (
+	"flag"
+	"github.com/Laremere/line-of-sight/common"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden images instead of comparing against them")
+
+const testMap = `
+1111111111111111
+1000000010000001
+10*0000010000*01
+1000000000000001
+1000000210000001
+1111101110111111
+1000000000000001
+1000000030000001
+1000000000000001
+1111111111111111
+`
+
+var testCamera = Camera{[2]float32{7.5, 4.5}, 24, 384, 240}
+
+// A player and their teammate, looking different ways
+var testViewers = []common.Viewer{
+	{[2]float32{4, 3}, [2]float32{0.8, 0.6}},
+	{[2]float32{12, 7}, [2]float32{-1, 0}},
+}
+
+func testCanvas(t *testing.T) (*common.Map, *Canvas, []common.Light) {
+	m, err := common.ParseMap(testMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lights := []common.Light{}
+	for _, lamp := range m.Lamps {
+		lights = append(lights, common.LampLight(lamp[0], lamp[1]))
+	}
+	for _, viewer := range testViewers {
+		lights = append(lights, common.PlayerLight(viewer.Position, viewer.Facing))
+	}
+	canvas := NewCanvas(testCamera)
+	canvas.Shadow(m, testViewers, common.DefaultVision)
+	canvas.Light(m, lights)
+	return m, canvas, lights
+}
+
+// Every pixel of open floor is shadowed exactly when none of the viewers
+// can see it, which is what the OpenGL renderer's shadow volumes cover.
+func TestShadowMatchesSees(t *testing.T) {
+	m, canvas, _ := testCanvas(t)
+	hidden, mismatched := 0, 0
+	for y := 0; y < testCamera.Height; y++ {
+		for x := 0; x < testCamera.Width; x++ {
+			world := testCamera.World(x, y)
+			if m.Get(int(world[0]+0.5), int(world[1]+0.5)).Solid() {
+				continue
+			}
+			sees := common.DefaultVision.Sees(m, testViewers, world)
+			if !sees {
+				hidden++
+			}
+			if sees != (canvas.shadow[x+y*testCamera.Width] == 0) {
+				mismatched++
+			}
+		}
+	}
+	if hidden == 0 {
+		t.Error("nothing is hidden")
+	}
+	if mismatched > 0 {
+		t.Errorf("%d pixels shadowed differently from Sees", mismatched)
+	}
+}
+
+func TestLightMatchesLit(t *testing.T) {
+	m, canvas, lights := testCanvas(t)
+	for y := 0; y < testCamera.Height; y++ {
+		for x := 0; x < testCamera.Width; x++ {
+			i := x + y*testCamera.Width
+			if canvas.shadow[i] >= 1 {
+				continue
+			}
+			world := testCamera.World(x, y)
+			if lit := common.Lit(m, lights, world); canvas.light[i] != lit {
+				t.Fatalf("pixel %d, %d lit %v, expected %v", x, y, canvas.light[i], lit)
+			}
+		}
+	}
+}
+
+// Only what has been in sight is explored, blending across the edges.
+func TestExplored(t *testing.T) {
+	m, canvas, _ := testCanvas(t)
+	explored := NewExplored(m)
+	explored.Add(canvas)
+	cases := []struct {
+		position [2]float32
+		want     float32
+	}{
+		// In front of the first viewer, and where nobody looks
+		{[2]float32{5, 3}, 1},
+		{[2]float32{1, 1}, 0},
+		// Outside the map, clamped to its edge
+		{[2]float32{-3, -3}, 0},
+	}
+	for _, c := range cases {
+		if seen := explored.At(c.position); seen != c.want {
+			t.Errorf("%v explored %v, expected %v", c.position, seen, c.want)
+		}
+	}
+
+	// Looking away again leaves it explored
+	canvas = NewCanvas(testCamera)
+	canvas.Shadow(m, nil, common.DefaultVision)
+	explored.Add(canvas)
+	if seen := explored.At([2]float32{5, 3}); seen != 1 {
+		t.Errorf("forgot having seen 5, 3")
+	}
+}
+
+// A frame as the client's software renderer draws it for -render, seen by
+// the test viewers, compared against testdata/viewers.png.
+func TestGolden(t *testing.T) {
+	m, canvas, _ := testCanvas(t)
+	canvas.Explored = NewExplored(m)
+	canvas.Explored.Add(canvas)
+	canvas.Background()
+	canvas.Walls(m)
+	for _, viewer := range testViewers {
+		canvas.Quad(viewer.Position, 1, [3]float32{0, 0, 1}, 1, false)
+	}
+	canvas.Minimap(m, 280, 170, 6, true)
+
+	const golden = "testdata/viewers.png"
+	if *update {
+		file, err := os.Create(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := png.Encode(file, canvas.Image); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	file, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	want, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Bounds() != canvas.Image.Bounds() {
+		t.Fatalf("drew %v, expected %v", canvas.Image.Bounds(), want.Bounds())
+	}
+	for y := 0; y < testCamera.Height; y++ {
+		for x := 0; x < testCamera.Width; x++ {
+			if !similar(canvas.Image.At(x, y), want.At(x, y)) {
+				t.Fatalf("pixel %d, %d differs from %s, rerun with -update if that is intended", x, y, golden)
+			}
+		}
+	}
+}
+
+func similar(a, b color.Color) bool {
+	r1, g1, b1, _ := a.RGBA()
+	r2, g2, b2, _ := b.RGBA()
+	near := func(a, b uint32) bool {
+		return a <= b+2*0x101 && b <= a+2*0x101
+	}
+	return near(r1, r2) && near(g1, g2) && near(b1, b2)
+}
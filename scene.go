@@ -3,173 +3,201 @@ package main
 import (
 	"encoding/gob"
 	"github.com/Laremere/line-of-sight/common"
-	"github.com/go-gl/gl"
 	"log"
 	"math"
 	"net"
+	"time"
 )
 
 type Scene struct {
 	width, height int
-	walls         []Wall
+	world         *common.Map
+	changed       [][2]int
 	entities      []Entity
 }
 
-func newScene(width, height int) *Scene {
+func newScene(m *common.Map) *Scene {
 	return &Scene{
-		width, height,
-		make([]Wall, width*height),
+		m.Width, m.Height,
+		m.Copy(),
+		make([][2]int, 0),
 		make([]Entity, 0),
 	}
 }
 
-func (scene *Scene) getWall(x, y int) Wall {
-	if x < 0 || y < 0 || x >= scene.width || y >= scene.height {
-		return WallStone
+func (scene *Scene) getWall(x, y int) common.Wall {
+	return scene.world.Get(x, y)
+}
+
+func (scene *Scene) lampLights() []common.Light {
+	lights := make([]common.Light, 0, len(scene.world.Lamps))
+	for _, lamp := range scene.world.Lamps {
+		lights = append(lights, common.LampLight(lamp[0], lamp[1]))
 	}
-	return scene.walls[x+y*scene.width]
+	return lights
 }
 
 func (scene *Scene) isNotWall(x, y int) int {
-	if x < 0 || y < 0 || x >= scene.width || y >= scene.height {
+	if scene.getWall(x, y).Solid() {
 		return 0
 	}
-	if scene.walls[x+y*scene.width] == WallNone {
-		return 1
-	}
-	return 0
+	return 1
 }
 
-func (scene *Scene) setWall(x, y int, wall Wall) {
-	scene.walls[x+y*scene.width] = wall
+// setWall changes a tile and records it so the renderer can rebuild the
+// shadow geometry around it.
+func (scene *Scene) setWall(x, y int, wall common.Wall) {
+	if scene.world.Get(x, y) == wall {
+		return
+	}
+	scene.world.Set(x, y, wall)
+	scene.changed = append(scene.changed, [2]int{x, y})
 }
 
-type Wall int
-
-const (
-	WallNone Wall = iota
-	WallStone
-)
-
 type Entity interface {
 	step(*Scene, *InputState, *OutputState)
-	draw(*Draw)
+	draw(Renderer)
 }
 
 type InputState struct {
 	direction [2]float32
-	keydown   map[string]bool
+	// Where the mouse points relative to the center of the screen, zero
+	// when there is no mouse
+	aim      [2]float32
+	interact bool
+	sprint   bool
 }
 
 type OutputState struct {
-	screenCenter [2]float32
-	screenBounds [2]float32
+	screenCenter  [2]float32
+	screenBounds  [2]float32
+	pixelsPerTile float32
+	// How far the frame being drawn is between the last tick and the next
+	alpha  float32
+	facing [2]float32
+	vision common.Vision
+	// Everything casting light this tick
+	lights []common.Light
+	// What the heads up display shows, or nil for no display
+	hud     *Hud
+	minimap bool
+	// Whose sight the player shares
+	teammates []Enemy
+}
+
+// viewers returns everyone whose sight is shown, the player first, where
+// they are in the frame being drawn.
+func (ops *OutputState) viewers() []common.Viewer {
+	viewers := []common.Viewer{{ops.screenCenter, ops.facing}}
+	for _, teammate := range ops.teammates {
+		viewers = append(viewers, common.Viewer{
+			lerp(teammate.prevPosition, teammate.position, ops.alpha), teammate.facing,
+		})
+	}
+	return viewers
 }
 
 type Player struct {
-	position [2]float32
-	speed    float32
+	position     [2]float32
+	prevPosition [2]float32
+	facing       [2]float32
+	speed        float32
+	// Predicted here, and set from the server when the two drift apart
+	stamina common.Stamina
 }
 
 func NewPlayer() *Player {
-	return &Player{[2]float32{5, 5}, 0.1}
+	return &Player{[2]float32{5, 5}, [2]float32{5, 5}, [2]float32{1, 0}, 0.1, common.FullStamina()}
 }
 
 func (p *Player) step(scene *Scene, ips *InputState, ops *OutputState) {
-	p.position[0] += ips.direction[0] * p.speed
-	p.position[1] += ips.direction[1] * p.speed
-
-	tileX := float32(math.Floor(float64(p.position[0] + 0.5)))
-	tileY := float32(math.Floor(float64(p.position[1] + 0.5)))
-
-	right := p.position[0] > tileX
-	left := p.position[0] < tileX
-	top := p.position[1] > tileY
-	bottom := p.position[1] < tileY
-
-	if right && scene.getWall(int(tileX+1), int(tileY)) != WallNone {
-		p.position[0] = tileX
-	}
-	if left && scene.getWall(int(tileX-1), int(tileY)) != WallNone {
-		p.position[0] = tileX
-	}
-	if top && scene.getWall(int(tileX), int(tileY+1)) != WallNone {
-		p.position[1] = tileY
-	}
-	if bottom && scene.getWall(int(tileX), int(tileY-1)) != WallNone {
-		p.position[1] = tileY
+	p.prevPosition = p.position
+	speed := p.speed
+	sprinting := p.stamina.CanSprint(ips.sprint)
+	if sprinting {
+		speed *= common.SprintMultiplier
 	}
-
-	if top && right && scene.getWall(int(tileX+1), int(tileY+1)) != WallNone {
-		dx := p.position[0] - tileX
-		dy := p.position[1] - tileY
-		if dx > dy {
-			p.position[1] = tileY
-		} else {
-			p.position[0] = tileX
-		}
-	}
-	if top && left && scene.getWall(int(tileX-1), int(tileY+1)) != WallNone {
-		dx := tileX - p.position[0]
-		dy := p.position[1] - tileY
-		if dx > dy {
-			p.position[1] = tileY
-		} else {
-			p.position[0] = tileX
-		}
+	delta := [2]float32{ips.direction[0] * speed, ips.direction[1] * speed}
+	p.position = moveCircle(scene, p.position, delta, playerRadius)
+	p.stamina.Update(sprinting && p.position != p.prevPosition)
+
+	if ips.aim != [2]float32{0, 0} {
+		p.facing = normalize(ips.aim)
+	} else if ips.direction != [2]float32{0, 0} {
+		p.facing = normalize(ips.direction)
 	}
+	ops.facing = p.facing
+	ops.lights = append(ops.lights, common.PlayerLight(p.position, p.facing))
+}
 
-	if bottom && right && scene.getWall(int(tileX+1), int(tileY-1)) != WallNone {
-		dx := p.position[0] - tileX
-		dy := tileY - p.position[1]
-		if dx > dy {
-			p.position[1] = tileY
-		} else {
-			p.position[0] = tileX
-		}
-	}
-	if bottom && left && scene.getWall(int(tileX-1), int(tileY-1)) != WallNone {
-		dx := tileX - p.position[0]
-		dy := tileY - p.position[1]
-		if dx > dy {
-			p.position[1] = tileY
-		} else {
-			p.position[0] = tileX
-		}
-	}
+func (p *Player) interpolatedPosition(alpha float32) [2]float32 {
+	return lerp(p.prevPosition, p.position, alpha)
+}
 
-	_, _, _ = left, top, bottom
-	ops.screenCenter = p.position
+func normalize(v [2]float32) [2]float32 {
+	length := float32(math.Hypot(float64(v[0]), float64(v[1])))
+	return [2]float32{v[0] / length, v[1] / length}
 }
 
-func (p *Player) draw(draw *Draw) {
-	// uniColor := draw.simpleShader.GetUniformLocation("triangleColor")
-	// uniColor.Uniform3f(0.0, 1.0, 0.0)
+func lerp(from, to [2]float32, alpha float32) [2]float32 {
+	return [2]float32{
+		from[0] + (to[0]-from[0])*alpha,
+		from[1] + (to[1]-from[1])*alpha,
+	}
+}
 
-	// gl.PushMatrix()
-	// gl.Translatef(p.position[0], p.position[1], 0)
-	// gl.DrawArrays(gl.QUADS, 0, 6)
-	// gl.PopMatrix()
+func (p *Player) draw(draw Renderer) {
+	draw.minimapDot(p.interpolatedPosition(draw.interpolation()), playerDotColor)
 }
 
 type Enemy struct {
+	id           int
+	team         int
+	state        common.PlayerState
+	color        [3]float32
+	position     [2]float32
+	prevPosition [2]float32
+	facing       [2]float32
+}
+
+// Ghost marks where an enemy was last seen.
+type Ghost struct {
+	id       int
+	state    common.PlayerState
 	color    [3]float32
 	position [2]float32
+	age      int
 }
 
+// Predicted stamina further than this from the server's is replaced by it
+const staminaDrift = common.TickRate / 2
+
+// Ghosts fade out over this many ticks.
+const ghostLifetime = 5 * common.TickRate
+const ghostAlpha = 0.6
+
 type serverConn struct {
+	id            int
 	enemies       []Enemy
+	ghosts        []Ghost
 	player        *Player
 	gobin         *gob.Decoder
 	gobout        *gob.Encoder
 	serverUpdates chan *common.ServerState
+	hud           Hud
+	names         map[int]string
+	effects       *Effects
+	audio         *Audio
+	// Where thieves escape in the heist mode
+	exits [][2]int
 }
 
-func newServerConn(ipAddr string, player *Player) *serverConn {
+func newServerConn(ipAddr, name string, player *Player, audio *Audio) *serverConn {
 	var sc serverConn
 	sc.player = player
-	sc.enemies = make([]Enemy, 1)
-	sc.enemies[0] = Enemy{[3]float32{0.5, 0.5, 1}, [2]float32{5, 5}}
+	sc.audio = audio
+	sc.enemies = make([]Enemy, 0)
+	sc.effects = newEffects()
 
 	conn, err := net.Dial("tcp", ipAddr+":"+"2667")
 	if err != nil {
@@ -177,6 +205,10 @@ func newServerConn(ipAddr string, player *Player) *serverConn {
 	}
 	sc.gobout = gob.NewEncoder(conn)
 	sc.gobin = gob.NewDecoder(conn)
+	err = sc.gobout.Encode(common.Hello{Name: name})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	sc.serverUpdates = make(chan *common.ServerState, 5)
 	go func() {
@@ -192,38 +224,230 @@ func newServerConn(ipAddr string, player *Player) *serverConn {
 	return &sc
 }
 
-func (sc *serverConn) step(*Scene, *InputState, *OutputState) {
+func (sc *serverConn) step(scene *Scene, ips *InputState, ops *OutputState) {
 	var ss *common.ServerState
 outerLoop:
 	for {
 		select {
 		case ss = <-sc.serverUpdates:
+			// The server keeps sending a correction until it hears back
+			// from where it put us
+			if ss.Correction != nil {
+				sc.player.position = *ss.Correction
+				sc.player.prevPosition = *ss.Correction
+			}
+			for _, change := range ss.TileChanges {
+				// A server running a different map can send changes to
+				// tiles this one doesn't have
+				if !scene.world.Contains(change.X, change.Y) {
+					log.Println("Ignoring change to a tile outside the map:", change.X, change.Y)
+					continue
+				}
+				// The first update catches up on every door opened before
+				// joining, which shouldn't all be heard at once
+				if sc.hud.connected && scene.getWall(change.X, change.Y) != change.Wall {
+					sc.playAt(scene, doorSound, [2]float32{float32(change.X), float32(change.Y)})
+				}
+				scene.setWall(change.X, change.Y, change.Wall)
+			}
+			// Events only come once, so none can be skipped along with
+			// the rest of an older state
+			for _, event := range ss.Events {
+				sc.effects.event(event)
+				switch event.Kind {
+				case common.EventTag:
+					sc.playAt(scene, tagSound, event.Position)
+				case common.EventNoise:
+					// Footsteps of players out of sight, muffled by the
+					// walls in between
+					sc.playAt(scene, footstepSound, event.Position)
+				}
+			}
 		default:
 			break outerLoop
 		}
 	}
 	if ss != nil {
+		sc.id = ss.Id
+		sc.updateHud(ss)
 		sc.player.speed = ss.Speed
+		// The server's stamina is a round trip behind, so it is only taken
+		// when the prediction has gone wrong
+		if math.Abs(float64(ss.Stamina.Left-sc.player.stamina.Left)) > staminaDrift {
+			sc.player.stamina = ss.Stamina
+		}
+		ops.vision = ss.Vision
+		previous := make(map[int][2]float32)
+		for _, enemy := range sc.enemies {
+			previous[enemy.id] = enemy.position
+		}
+		// The server only sends the players we can see, so anyone missing
+		// has just gone out of sight
+		visible := make(map[int]bool)
+		for _, player := range ss.Players {
+			visible[player.Id] = true
+		}
+		for _, enemy := range sc.enemies {
+			if !visible[enemy.id] {
+				sc.ghosts = append(sc.ghosts, Ghost{enemy.id, enemy.state, enemy.color, enemy.position, 0})
+			}
+		}
+
 		sc.enemies = make([]Enemy, len(ss.Players))
 		for i := range ss.Players {
+			sc.enemies[i].id = ss.Players[i].Id
+			sc.enemies[i].team = ss.Players[i].Team
+			sc.enemies[i].state = ss.Players[i].State
 			sc.enemies[i].color = ss.Players[i].Color
 			sc.enemies[i].position = ss.Players[i].Position
+			sc.enemies[i].facing = ss.Players[i].Facing
+			if prevPosition, ok := previous[ss.Players[i].Id]; ok {
+				sc.enemies[i].prevPosition = prevPosition
+			} else {
+				sc.enemies[i].prevPosition = ss.Players[i].Position
+			}
+		}
+		sc.hud.team = sc.team()
+		sc.exits = scene.world.Exits
+	} else {
+		for i := range sc.enemies {
+			sc.enemies[i].prevPosition = sc.enemies[i].position
+		}
+	}
+
+	ops.teammates = ops.teammates[:0]
+	team := sc.team()
+	for _, enemy := range sc.enemies {
+		// The local player's light and sight come from Player, which is more
+		// up to date
+		if enemy.id == sc.id {
+			continue
 		}
+		light := common.PlayerLight(enemy.position, enemy.facing)
+		if enemy.team == team {
+			ops.teammates = append(ops.teammates, enemy)
+		} else {
+			// An opponent's glow would light up their own sprite, so they
+			// are only shown when something else lights them
+			light.Glow = 0
+		}
+		ops.lights = append(ops.lights, light)
+	}
+	sc.updateGhosts(scene, ops)
+	for _, step := range sc.effects.step(sc.enemies) {
+		sc.playAt(scene, footstepSound, step)
 	}
 
-	cs := common.ClientState{sc.player.position}
+	sc.hud.stamina = sc.player.stamina
+	ops.hud = &sc.hud
+
+	cs := common.ClientState{
+		Position: sc.player.position,
+		Facing:   sc.player.facing,
+		Interact: ips.interact,
+		Sprint:   ips.sprint,
+		Time:     time.Now().UnixNano(),
+	}
 	sc.gobout.Encode(cs)
 }
 
-func (sc *serverConn) draw(draw *Draw) {
-	uniColor := draw.simpleShader.GetUniformLocation("triangleColor")
+// playAt plays sound from position, as heard by the player through the
+// walls in between.
+func (sc *serverConn) playAt(scene *Scene, sound *Sound, position [2]float32) {
+	listener := sc.player.position
+	offset := [2]float32{position[0] - listener[0], position[1] - listener[1]}
+	sc.audio.play(sound, offset, scene.world.SolidBetween(listener, position))
+}
+
+func (sc *serverConn) updateHud(ss *common.ServerState) {
+	sc.hud.connected = true
+	sc.hud.lastUpdate = time.Now()
+	if ss.Echo != 0 {
+		sc.hud.ping = time.Duration(time.Now().UnixNano() - ss.Echo)
+	}
+	sc.hud.id = ss.Id
+	sc.hud.invincibleTime = ss.InvincibleTime
+	sc.hud.scoreboard = ss.Scoreboard
+	sc.hud.round = ss.Round
+	sc.hud.heist = ss.Heist
+	sc.names = make(map[int]string)
+	for _, score := range ss.Scoreboard {
+		sc.names[score.Id] = score.Name
+		if score.Id == ss.Id {
+			sc.hud.state = score.State
+		}
+	}
+}
+
+// team returns the player's own team, as the server last sent it.
+func (sc *serverConn) team() int {
 	for _, enemy := range sc.enemies {
-		uniColor.Uniform3f(enemy.color[0], enemy.color[1], enemy.color[2])
+		if enemy.id == sc.id {
+			return enemy.team
+		}
+	}
+	return -1
+}
 
-		gl.PushMatrix()
-		gl.Translatef(enemy.position[0], enemy.position[1], 0)
-		gl.DrawArrays(gl.QUADS, 0, 6)
-		gl.PopMatrix()
+// updateGhosts ages the ghosts, dropping those that are stale, whose enemy
+// is back in sight, or whose spot is in sight of the team with nobody there.
+func (sc *serverConn) updateGhosts(scene *Scene, ops *OutputState) {
+	visible := make(map[int]bool)
+	for _, enemy := range sc.enemies {
+		visible[enemy.id] = true
+	}
+
+	viewers := []common.Viewer{{sc.player.position, sc.player.facing}}
+	for _, teammate := range ops.teammates {
+		viewers = append(viewers, common.Viewer{teammate.position, teammate.facing})
+	}
+
+	ghosts := sc.ghosts[:0]
+	for _, ghost := range sc.ghosts {
+		ghost.age++
+		if ghost.age > ghostLifetime || visible[ghost.id] {
+			continue
+		}
+		if ops.vision.Sees(scene.world, viewers, ghost.position) {
+			continue
+		}
+		ghosts = append(ghosts, ghost)
+	}
+	sc.ghosts = ghosts
+}
 
+func (sc *serverConn) draw(draw Renderer) {
+	if sc.hud.heist != nil {
+		for _, exit := range sc.exits {
+			position := [2]float32{float32(exit[0]), float32(exit[1])}
+			draw.effect(position, [2]float32{1, 1}, exitColor, 0.4, true)
+			draw.minimapDot(position, exitColor)
+		}
+		for _, loot := range sc.hud.heist.Loot {
+			draw.effect([2]float32{float32(loot[0]), float32(loot[1])}, [2]float32{0.5, 0.5}, lootColor, 1, false)
+		}
+	}
+	for _, ghost := range sc.ghosts {
+		fade := 1 - float32(ghost.age)/ghostLifetime
+		draw.ghost(ghost.position, ghost.state, ghost.color, ghostAlpha*fade)
+	}
+	sc.effects.drawFootprints(draw)
+	for _, enemy := range sc.enemies {
+		position := lerp(enemy.prevPosition, enemy.position, draw.interpolation())
+		draw.sprite(position, enemy.state, enemy.color)
+		if enemy.state == common.PlayerInvincible {
+			sc.effects.drawOutline(draw, position)
+		}
+	}
+	sc.effects.drawBursts(draw)
+	sc.effects.drawRings(draw)
+	// Names go on top of every sprite
+	for _, enemy := range sc.enemies {
+		if enemy.id != sc.id {
+			position := lerp(enemy.prevPosition, enemy.position, draw.interpolation())
+			// Sprites may be drawn in team colors, so names show the state
+			drawLabel(draw, position, sc.names[enemy.id], stateColors[enemy.state])
+			draw.minimapDot(position, enemy.color)
+		}
 	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/go-gl/gl"
+	"image"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// renderImage draws a frame offscreen instead of to the window, and reads
+// it back.
+func (draw *Draw) renderImage(scene *Scene, ops *OutputState) *image.RGBA {
+	draw.target = draw.imageFb
+	draw.draw(scene, ops)
+	draw.target = 0
+
+	draw.imageFb.Bind()
+	img := draw.readPixels()
+	draw.imageFb.Unbind()
+	return img
+}
+
+// readPixels reads back the frame in the bound framebuffer, which is the
+// window's when none is.
+func (draw *Draw) readPixels() *image.RGBA {
+	width, height := draw.screenWidth, draw.screenHeight
+	pixels := make([]byte, width*height*4)
+	gl.PixelStorei(gl.PACK_ALIGNMENT, 1)
+	gl.ReadPixels(0, 0, width, height, gl.RGBA, gl.UNSIGNED_BYTE, pixels)
+
+	// OpenGL's rows start at the bottom
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		copy(img.Pix[y*img.Stride:(y+1)*img.Stride], pixels[(height-1-y)*width*4:])
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+// renderToFile renders the map as seen from the -at and -facing flags to
+// the -render file.
+func renderToFile(renderer Renderer, screenWidth, screenHeight int) error {
+	if renderFacing == (vec2Flag{0, 0}) {
+		return errors.New("-facing needs a direction, not 0,0")
+	}
+	gameMap, err := common.LoadMap(*mapFile)
+	if err != nil {
+		return err
+	}
+	scene := newScene(gameMap)
+	renderer.generateWalls(scene)
+
+	ops := OutputState{
+		screenCenter:  renderAt,
+		screenBounds:  [2]float32{float32(screenWidth), float32(screenHeight)},
+		pixelsPerTile: float32(*zoom),
+		facing:        normalize(renderFacing),
+		vision:        common.DefaultVision,
+		minimap:       true,
+	}
+	ops.lights = append(scene.lampLights(), common.PlayerLight(ops.screenCenter, ops.facing))
+	return savePNG(*renderFile, renderer.renderImage(scene, &ops))
+}
+
+func savePNG(filename string, img image.Image) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, img)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// vec2Flag is a flag given as two comma separated numbers.
+type vec2Flag [2]float32
+
+func (v *vec2Flag) String() string {
+	return strconv.FormatFloat(float64(v[0]), 'g', -1, 32) + "," +
+		strconv.FormatFloat(float64(v[1]), 'g', -1, 32)
+}
+
+func (v *vec2Flag) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return errors.New("Expected x,y: " + value)
+	}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+		if err != nil {
+			return err
+		}
+		v[i] = float32(f)
+	}
+	return nil
+}
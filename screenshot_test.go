@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+)
+
+// The frames -render draws are checked headless by the raster package's
+// golden test, since this package needs SDL and OpenGL to build.
+
+func TestRenderToFileNoFacing(t *testing.T) {
+	facing := renderFacing
+	t.Cleanup(func() { renderFacing = facing })
+	renderFacing = vec2Flag{0, 0}
+	if err := renderToFile(NewSoftwareRenderer(32, 32), 32, 32); err == nil {
+		t.Error("rendered facing 0,0")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"math"
+)
+
+// Heist is the heist mode: thieves pick up loot and escape through an exit
+// with it, while guards catch them by touching them. Teams swap sides
+// between rounds.
+type Heist struct {
+	// The loot still lying where it started
+	loot     map[[2]int]bool
+	escaped  int
+	required int
+	wins     [2]int
+	// Whether a round has been played, so sides swap for the next
+	played bool
+}
+
+// A round lasts this many ticks
+const heistRoundTime = 3 * 60 * common.TickRate
+
+// Thieves have to escape with this share of the loot to win
+const heistLootShare = 2.0 / 3
+
+// Players pick up loot and escape through exits this close to them
+const heistReach = 0.7
+
+// start puts back all the loot, and swaps the teams' sides once a round has
+// been played.
+func (game *Heist) start(world *common.Map, players map[int]*Player) {
+	game.loot = make(map[[2]int]bool)
+	for _, loot := range world.Loot {
+		game.loot[loot] = true
+	}
+	game.escaped = 0
+	game.required = int(math.Ceil(float64(len(world.Loot)) * heistLootShare))
+	for _, player := range players {
+		if game.played {
+			player.team = 1 - player.team
+		}
+		game.join(player)
+	}
+	game.played = false
+}
+
+// join gives a player the state of their side.
+func (game *Heist) join(player *Player) {
+	player.carrying = nil
+	if player.team == common.TeamGuards {
+		player.state = common.PlayerIt
+	} else {
+		player.state = common.PlayerRun
+	}
+}
+
+func (game *Heist) leave(player *Player) {
+	game.drop(player)
+}
+
+func (game *Heist) tick(world *common.Map, players map[int]*Player, events []common.Event) ([]common.Event, string) {
+	game.played = true
+	thieves, thievesLeft := 0, 0
+	for _, thief := range players {
+		if thief.team == common.TeamThieves {
+			thieves++
+		}
+		if thief.state != common.PlayerRun {
+			continue
+		}
+		if guard := touching(players, thief, common.PlayerIt); guard != nil {
+			events = append(events, common.Event{
+				common.EventTag, guard.id, thief.id, thief.position, 0,
+			})
+			game.drop(thief)
+			thief.state = common.PlayerCaught
+			thief.tagged++
+			guard.tags++
+			continue
+		}
+		thievesLeft++
+
+		for loot := range game.loot {
+			if within(thief.position, loot, heistReach) {
+				delete(game.loot, loot)
+				thief.carrying = append(thief.carrying, loot)
+			}
+		}
+		for _, exit := range world.Exits {
+			if within(thief.position, exit, heistReach) {
+				game.escaped += len(thief.carrying)
+				thief.loot += len(thief.carrying)
+				thief.carrying = nil
+			}
+		}
+	}
+
+	switch {
+	case game.escaped >= game.required:
+		return events, game.win(common.TeamThieves)
+	case thieves > 0 && thievesLeft == 0:
+		return events, game.win(common.TeamGuards)
+	}
+	return events, ""
+}
+
+func (game *Heist) timeUp(players map[int]*Player) string {
+	return game.win(common.TeamGuards)
+}
+
+func (game *Heist) win(team int) string {
+	game.wins[team]++
+	return common.TeamNames[team] + " win!"
+}
+
+func (game *Heist) roundTime() int {
+	return heistRoundTime
+}
+
+func (game *Heist) report(player *Player, state *common.ServerState) {
+	loot := make([][2]int, 0, len(game.loot))
+	for position := range game.loot {
+		loot = append(loot, position)
+	}
+	state.Heist = &common.Heist{
+		Loot:     loot,
+		Escaped:  game.escaped,
+		Required: game.required,
+		Carrying: len(player.carrying),
+		Wins:     game.wins,
+	}
+}
+
+// drop puts the loot a player is carrying back where it was taken from.
+func (game *Heist) drop(player *Player) {
+	for _, loot := range player.carrying {
+		game.loot[loot] = true
+	}
+	player.carrying = nil
+}
+
+// touching returns a player in state that is touching player, or nil.
+func touching(players map[int]*Player, player *Player, state common.PlayerState) *Player {
+	for _, other := range players {
+		if other.state != state || other.team == player.team {
+			continue
+		}
+		diffX := player.position[0] - other.position[0]
+		diffY := player.position[1] - other.position[1]
+		if diffX < 1 && diffX > -1 && diffY > -1 && diffY < 1 {
+			return other
+		}
+	}
+	return nil
+}
+
+func within(position [2]float32, tile [2]int, reach float64) bool {
+	return math.Hypot(float64(position[0])-float64(tile[0]), float64(position[1])-float64(tile[1])) < reach
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+)
+
+// Mode is a game played in rounds, such as tag or the heist.
+type Mode interface {
+	// start sets everyone up for a new round, before they are spawned
+	start(world *common.Map, players map[int]*Player)
+	// join sets up a player joining partway through a round, and leave
+	// cleans up after one leaving
+	join(player *Player)
+	leave(player *Player)
+	// tick plays a tick of the round, returning how it ended once it has
+	tick(world *common.Map, players map[int]*Player, events []common.Event) ([]common.Event, string)
+	// timeUp ends the round when its time runs out, returning how it ended
+	timeUp(players map[int]*Player) string
+	roundTime() int
+	// report adds what the mode has to tell player to their state
+	report(player *Player, state *common.ServerState)
+}
+
+// Round runs the cycle of rounds: waiting for enough players, counting down
+// with everyone at a spawn point, playing the mode, and showing the
+// results.
+type Round struct {
+	common.Round
+	mode   Mode
+	vision common.Vision
+}
+
+// A round starts once this many players are connected
+const minPlayers = 2
+
+const countdownTime = 5 * common.TickRate
+const resultsTime = 8 * common.TickRate
+
+func (round *Round) tick(world *common.Map, players map[int]*Player, events []common.Event) []common.Event {
+	switch round.Phase {
+	case common.PhaseWaiting:
+		if len(players) >= minPlayers {
+			round.countdown(world, players)
+		}
+	case common.PhaseCountdown:
+		round.TimeLeft--
+		if len(players) < minPlayers {
+			round.wait(players)
+		} else if round.TimeLeft <= 0 {
+			round.Phase = common.PhasePlay
+			round.TimeLeft = round.mode.roundTime()
+		}
+	case common.PhasePlay:
+		round.TimeLeft--
+		var result string
+		events, result = round.mode.tick(world, players, events)
+		if result == "" && round.TimeLeft <= 0 {
+			result = round.mode.timeUp(players)
+		}
+		if result != "" {
+			round.Phase = common.PhaseResults
+			round.TimeLeft = resultsTime
+			round.Result = result
+			hold(players)
+		}
+	case common.PhaseResults:
+		round.TimeLeft--
+		if round.TimeLeft > 0 {
+			break
+		}
+		if len(players) >= minPlayers {
+			round.countdown(world, players)
+		} else {
+			round.wait(players)
+		}
+	}
+	return events
+}
+
+// countdown starts the next round with everyone's round stats cleared, and
+// puts them back at a spawn point.
+func (round *Round) countdown(world *common.Map, players map[int]*Player) {
+	round.Phase = common.PhaseCountdown
+	round.TimeLeft = countdownTime
+	round.Number++
+	hold(players)
+	for _, player := range players {
+		player.tags, player.loot, player.tagged = 0, 0, 0
+		player.state = common.PlayerRun
+		player.stamina = common.FullStamina()
+	}
+	round.mode.start(world, players)
+
+	// Whoever is it is placed first, and everyone else away from those
+	// already placed
+	order := make([]*Player, 0, len(players))
+	for _, player := range players {
+		if player.state == common.PlayerIt {
+			order = append(order, player)
+		}
+	}
+	for _, player := range players {
+		if player.state != common.PlayerIt {
+			order = append(order, player)
+		}
+	}
+	placed := make(map[int]*Player)
+	for _, player := range order {
+		spawn(world, round.vision, placed, player)
+		placed[player.id] = player
+	}
+}
+
+func (round *Round) wait(players map[int]*Player) {
+	round.Phase = common.PhaseWaiting
+	round.TimeLeft = 0
+	for _, player := range players {
+		player.state = common.PlayerRun
+	}
+}
+
+// join brings a new player into whatever phase the round is in.
+func (round *Round) join(world *common.Map, players map[int]*Player, player *Player) {
+	player.state = common.PlayerRun
+	if round.underway() {
+		round.mode.join(player)
+	}
+	spawn(world, round.vision, players, player)
+}
+
+func (round *Round) leave(player *Player) {
+	if round.underway() {
+		round.mode.leave(player)
+	}
+}
+
+// underway reports whether the mode has started the round, which it does
+// at the start of the countdown.
+func (round *Round) underway() bool {
+	return round.Phase == common.PhaseCountdown || round.Phase == common.PhasePlay
+}
+
+// speed is how fast player may move, with everyone held still while
+// counting down and showing results.
+func (round *Round) speed(player *Player) float32 {
+	if round.Phase == common.PhaseCountdown || round.Phase == common.PhaseResults {
+		return 0
+	}
+	return speedMap[player.state]
+}
+
+// hold stops everyone moving straight away, rather than after the grace
+// given to moves sent before a slowdown.
+func hold(players map[int]*Player) {
+	for _, player := range players {
+		player.allowedSpeed = 0
+		player.slowdown = 0
+		player.budget = 0
+	}
+}
+
+// teleport moves a player, ignoring their moves until they have heard about
+// it.
+func teleport(player *Player, position [2]float32) {
+	player.position = position
+	player.noisePosition = position
+	player.positioned = true
+	player.correction = &position
+	// Whatever they saved up was for where they were before
+	player.budget = 0
+}
@@ -2,18 +2,67 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
 	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/line-of-sight/raster"
+	"image/png"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+var fov = flag.Float64("fov", 110, "Width of the players' vision cone in degrees")
+var peripheral = flag.Float64("peripheral", float64(common.DefaultVision.Peripheral),
+	"Radius in tiles players can see in every direction")
+
+var mode = flag.String("mode", "tag", "Game to play: tag, or heist where thieves steal loot past guards")
+var teams = flag.Int("teams", 0, "Number of teams, whose players share sight, or 0 for everyone alone")
+
+var preview = flag.String("preview", "", "Write a PNG preview of the map to this file and exit")
+
 func main() {
-	go masterLoop()
+	flag.Parse()
+
+	gameMap, err := common.LoadMap("map.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(openTiles(gameMap)) == 0 {
+		log.Fatal("The map has no open floor to spawn players on")
+	}
+	if *preview != "" {
+		err = writePreview(gameMap, *preview)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	var game Mode
+	switch *mode {
+	case "tag":
+		game = &Tag{}
+	case "heist":
+		if len(gameMap.Loot) == 0 || len(gameMap.Exits) == 0 {
+			log.Fatal("The heist mode needs a map with loot and exits")
+		}
+		// Thieves and guards
+		*teams = 2
+		game = &Heist{}
+	default:
+		log.Fatal("Unknown mode: ", *mode)
+	}
+	vision := common.Vision{
+		Fov:        float32(*fov * math.Pi / 180),
+		Peripheral: float32(*peripheral),
+	}
+	go masterLoop(gameMap, vision, game)
 
 	go func() {
 		playerId := 0
@@ -57,10 +106,20 @@ func main() {
 
 func handleConnection(conn net.Conn) {
 	log.Println("New connection: ", conn.LocalAddr())
-	player := Player{id: <-playerIds, toSend: make(chan *common.ServerState)}
-	playerNew <- &player
+	player := Player{id: <-playerIds, toSend: make(chan *common.ServerState), stamina: common.FullStamina()}
 	player.gobIn = gob.NewDecoder(conn)
 	player.gobout = gob.NewEncoder(conn)
+
+	var hello common.Hello
+	err := player.gobIn.Decode(&hello)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
+	player.name = playerName(hello.Name, player.id)
+	playerNew <- &player
+
 	go func() {
 		var state common.ClientState
 		for {
@@ -73,7 +132,7 @@ func handleConnection(conn net.Conn) {
 				return
 			}
 			playerUpdates <- playerUpdate{
-				player.id, state.Position,
+				player.id, state.Position, state.Facing, state.Interact, state.Sprint, state.Time,
 			}
 		}
 	}()
@@ -92,72 +151,430 @@ func handleConnection(conn net.Conn) {
 	}()
 }
 
-func masterLoop() {
-	ticker := time.NewTicker(time.Second / 60)
+func masterLoop(gameMap *common.Map, vision common.Vision, game Mode) {
+	ticker := time.NewTicker(time.Second / common.TickRate)
 	players := make(map[int]*Player)
+	world := gameMap.Copy()
+	round := &Round{mode: game, vision: vision}
+	tileChanges := make([]common.TileChange, 0)
+	events := make([]common.Event, 0)
+	ticks := 0
 	for {
 		select {
 		case player := <-playerNew:
+			player.team = pickTeam(players, player.id)
+			round.join(world, players, player)
 			players[player.id] = player
+			player.allowedSpeed = round.speed(player)
+			// Bring the new player's copy of the map up to date
+			for i, wall := range world.Walls {
+				if wall != gameMap.Walls[i] {
+					player.tileBacklog = append(player.tileBacklog, common.TileChange{
+						i % world.Width, i / world.Width, wall,
+					})
+				}
+			}
 		case id := <-playerDelete:
+			if player, ok := players[id]; ok {
+				round.leave(player)
+			}
 			delete(players, id)
 			log.Println("Client closed", id)
 		case update := <-playerUpdates:
-			players[update.id].position = update.position
+			move(players[update.id], update)
+			players[update.id].facing = update.facing
+			players[update.id].echo = update.time
+			if update.interact {
+				if change, ok := interact(world, players, update.position); ok {
+					world.Set(change.X, change.Y, change.Wall)
+					tileChanges = append(tileChanges, change)
+				}
+			}
 		case <-ticker.C:
 			serverState := common.ServerState{
-				make([]common.Player, 0, len(players)),
-				0.2,
+				Speed:  0.2,
+				Vision: vision,
 			}
 
-			numIt := 0
+			events = round.tick(world, players, events)
+			serverState.Round = round.Round
+
+			// Moves sent before hearing about a slowdown are still allowed
+			// for a while
 			for _, player := range players {
-				if player.state == playerInvincible {
-					player.invincibleTime -= 1
-					if player.invincibleTime <= 0 {
-						player.state = playerRun
-					}
+				speed := round.speed(player)
+				if speed >= player.allowedSpeed {
+					player.slowdown = 0
+				} else {
+					player.slowdown++
 				}
-
-				if player.state == playerIt {
-					numIt += 1
-					for _, victum := range players {
-						if player.id == victum.id {
-							continue
-						}
-						diffX := player.position[0] - victum.position[0]
-						diffY := player.position[1] - victum.position[1]
-
-						if diffX < 1 && diffX > -1 && diffY > -1 && diffY < 1 {
-							if victum.state == playerRun {
-								victum.state = playerIt
-								player.state = playerInvincible
-								player.invincibleTime = 300
-							}
-						}
-					}
+				if player.slowdown == 0 || player.slowdown > slowdownGrace {
+					player.allowedSpeed = speed
 				}
+				refillBudget(player)
 			}
 
-			if numIt == 0 {
-				for _, player := range players {
-					player.state = playerIt
-				}
+			lights := make([]common.Light, 0, len(world.Lamps)+len(players))
+			for _, lamp := range world.Lamps {
+				lights = append(lights, common.LampLight(lamp[0], lamp[1]))
+			}
+			for _, player := range players {
+				lights = append(lights, common.PlayerLight(player.position, player.facing))
 			}
+			sights := teamSights(players)
 
+			serverState.Scoreboard = make([]common.Score, 0, len(players))
 			for _, player := range players {
-				serverState.Players = append(serverState.Players, common.Player{
-					player.position, colorMap[player.state],
+				serverState.Scoreboard = append(serverState.Scoreboard, common.Score{
+					player.id, player.name, player.state, player.team, player.tags, player.loot, player.tagged,
 				})
 			}
+			sort.Sort(byId(serverState.Scoreboard))
+
+			ticks++
+			heard := make(map[int][]common.Event)
+			if ticks%noiseInterval == 0 {
+				heard = noises(world, vision, lights, sights, players)
+			}
 
 			for _, player := range players {
 				personalServerState := serverState
-				personalServerState.Speed = speedMap[player.state]
+				personalServerState.Id = player.id
+				personalServerState.Players = make([]common.Player, 0, len(players))
+				for _, other := range players {
+					if other.team == player.team || canSeePlayer(world, vision, lights, sights[player.team], other) {
+						personalServerState.Players = append(personalServerState.Players, common.Player{
+							other.id, other.position, other.facing, other.state, teamColor(other.team), other.team,
+						})
+					}
+				}
+				personalServerState.Speed = round.speed(player)
+				round.mode.report(player, &personalServerState)
+				personalServerState.Echo = player.echo
+				personalServerState.Stamina = player.stamina
+				// Sent every tick until they catch up, in case this state
+				// is passed over for a later one
+				personalServerState.Correction = player.correction
+				for _, event := range events {
+					if event.Player == player.id || event.Target == player.id ||
+						canSeePoint(world, vision, lights, sights[player.team], event.Position) {
+						personalServerState.Events = append(personalServerState.Events, event)
+					}
+				}
+				personalServerState.Events = append(personalServerState.Events, heard[player.id]...)
+				personalServerState.TileChanges = append(player.tileBacklog, tileChanges...)
+				player.tileBacklog = nil
 				player.toSend <- &personalServerState
 			}
+			tileChanges = make([]common.TileChange, 0)
+			events = make([]common.Event, 0)
+		}
+	}
+}
+
+// move takes a player's new position if they have the budget to get there.
+// Moves that are too far are cut short and the player is told where they
+// really are, ignoring their moves until they catch up.
+func move(player *Player, update playerUpdate) {
+	player.sprint = update.sprint
+	if !player.positioned {
+		player.position = update.position
+		player.positioned = true
+		return
+	}
+	diffX := float64(update.position[0] - player.position[0])
+	diffY := float64(update.position[1] - player.position[1])
+	dist := float32(math.Hypot(diffX, diffY))
+
+	if dist <= player.budget {
+		player.position = update.position
+		player.budget -= dist
+		player.travelled += dist
+		player.correction = nil
+	} else if player.correction == nil {
+		player.position[0] += float32(diffX) / dist * player.budget
+		player.position[1] += float32(diffY) / dist * player.budget
+		player.travelled += player.budget
+		player.budget = 0
+		correction := player.position
+		player.correction = &correction
+	}
+}
+
+// refillBudget settles the stamina for how the player moved over the last
+// tick, and gives them the distance they can move in the next, at sprinting
+// speed while they have the stamina. The budget builds up each server tick
+// rather than each update, so sending more updates doesn't get anyone
+// further or rest their stamina, but a few ticks of it are kept for updates
+// held up on the way. Going further than walking pays for sprinting, asked
+// for or not.
+func refillBudget(player *Player) {
+	walk := player.allowedSpeed*speedTolerance + 0.001
+	sprinted := player.travelled > 0 && (player.sprint || player.travelled > walk)
+	player.stamina.Update(sprinted && player.stamina.CanSprint(true))
+	player.travelled = 0
+
+	speed := walk
+	if player.stamina.CanSprint(true) {
+		speed = player.allowedSpeed*common.SprintMultiplier*speedTolerance + 0.001
+	}
+	player.budget = float32(math.Min(float64(player.budget+speed), float64(speed*budgetTicks)))
+}
+
+// Moves can be this much longer than the player's speed, for rounding
+const speedTolerance = 1.05
+
+// Players can save up this many ticks of movement
+const budgetTicks = 3
+
+// How many ticks players can keep moving at their old speed after a slowdown
+const slowdownGrace = common.TickRate
+
+// interact finds the door or crate nearest to position, within reach, and
+// returns the change using it would make.
+func interact(world *common.Map, players map[int]*Player, position [2]float32) (common.TileChange, bool) {
+	tileX := int(math.Floor(float64(position[0] + 0.5)))
+	tileY := int(math.Floor(float64(position[1] + 0.5)))
+
+	var best common.TileChange
+	bestDist := float32(interactReach * interactReach)
+	found := false
+	for x := tileX - 1; x <= tileX+1; x++ {
+		for y := tileY - 1; y <= tileY+1; y++ {
+			var change common.TileChange
+			switch world.Get(x, y) {
+			case common.WallDoor:
+				change = common.TileChange{x, y, common.WallDoorOpen}
+			case common.WallDoorOpen:
+				if occupied(players, x, y) {
+					continue
+				}
+				change = common.TileChange{x, y, common.WallDoor}
+			case common.WallCrate:
+				change = common.TileChange{x, y, common.WallNone}
+			default:
+				continue
+			}
+			diffX := float32(x) - position[0]
+			diffY := float32(y) - position[1]
+			if dist := diffX*diffX + diffY*diffY; dist <= bestDist {
+				best, bestDist, found = change, dist, true
+			}
+		}
+	}
+	return best, found
+}
+
+// occupied reports whether any player overlaps the tile, so doors are never
+// closed on top of someone.
+func occupied(players map[int]*Player, x, y int) bool {
+	for _, player := range players {
+		diffX := player.position[0] - float32(x)
+		diffY := player.position[1] - float32(y)
+		if diffX < 1 && diffX > -1 && diffY > -1 && diffY < 1 {
+			return true
 		}
 	}
+	return false
+}
+
+const interactReach = 1.5
+
+// playerName cleans up the name a player asked for, giving them a default
+// when there is nothing left of it.
+func playerName(name string, id int) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if len(name) > maxNameLength {
+		name = name[:maxNameLength]
+	}
+	if name == "" {
+		name = "Player " + strconv.Itoa(id)
+	}
+	return name
+}
+
+const maxNameLength = 16
+
+type byId []common.Score
+
+func (s byId) Len() int           { return len(s) }
+func (s byId) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s byId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func writePreview(gameMap *common.Map, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(file, raster.Preview(gameMap, 8))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// canSeePlayer reports whether any lit part of target is inside, or within
+// visibilityMargin of, one of the viewers' vision cones and not hidden behind
+// walls. Players a team can't see are never sent to them. The target's own
+// light always falls on them, so it isn't counted.
+func canSeePlayer(world *common.Map, vision common.Vision, lights []common.Light, viewers []common.Viewer, target *Player) bool {
+	lights = withoutLight(lights, common.PlayerLight(target.position, target.facing))
+	for _, offset := range visibilityOffsets {
+		point := [2]float32{target.position[0] + offset[0], target.position[1] + offset[1]}
+		if common.Lit(world, lights, point) < common.LitThreshold {
+			continue
+		}
+		for _, margin := range marginOffsets {
+			if vision.Sees(world, viewers, [2]float32{point[0] + margin[0], point[1] + margin[1]}) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func canSeePoint(world *common.Map, vision common.Vision, lights []common.Light, viewers []common.Viewer, point [2]float32) bool {
+	return vision.Sees(world, viewers, point) && common.Lit(world, lights, point) >= common.LitThreshold
+}
+
+func withoutLight(lights []common.Light, own common.Light) []common.Light {
+	others := make([]common.Light, 0, len(lights))
+	for _, light := range lights {
+		if light != own {
+			others = append(others, light)
+		}
+	}
+	return others
+}
+
+// teamSights returns everyone each team sees through, by team.
+func teamSights(players map[int]*Player) map[int][]common.Viewer {
+	sights := make(map[int][]common.Viewer)
+	for _, player := range players {
+		sights[player.team] = append(sights[player.team], common.Viewer{player.position, player.facing})
+	}
+	return sights
+}
+
+// pickTeam puts a new player on the team with the fewest players, or on a
+// team of their own when there are no teams.
+func pickTeam(players map[int]*Player, id int) int {
+	if *teams <= 0 {
+		return id
+	}
+	sizes := make([]int, *teams)
+	for _, player := range players {
+		sizes[player.team]++
+	}
+	best := 0
+	for team, size := range sizes {
+		if size < sizes[best] {
+			best = team
+		}
+	}
+	return best
+}
+
+func teamColor(team int) [3]float32 {
+	return teamColors[team%len(teamColors)]
+}
+
+var teamColors = [][3]float32{
+	{0.2, 0.5, 1.0},
+	{1.0, 0.6, 0.1},
+	{0.7, 0.3, 1.0},
+	{0.2, 0.9, 0.8},
+	{1.0, 0.4, 0.7},
+	{0.8, 0.9, 0.2},
+}
+
+// noises works out how loud everyone has been since the last time, from how
+// fast they moved compared to how fast they can, and returns the noises each
+// player heard from someone they can't see, by player id.
+func noises(world *common.Map, vision common.Vision, lights []common.Light, sights map[int][]common.Viewer, players map[int]*Player) map[int][]common.Event {
+	heard := make(map[int][]common.Event)
+	for _, source := range players {
+		moved := math.Hypot(
+			float64(source.position[0]-source.noisePosition[0]),
+			float64(source.position[1]-source.noisePosition[1]))
+		source.noisePosition = source.position
+		speed := speedMap[source.state]
+		if speed == 0 {
+			continue
+		}
+		pace := float32(moved) / (speed * noiseInterval)
+		if pace < quietPace || pace > maxPace {
+			continue
+		}
+		radius := noiseMap[source.state] * pace
+
+		for _, listener := range players {
+			if listener.team == source.team || canSeePlayer(world, vision, lights, sights[listener.team], source) {
+				continue
+			}
+			diffX := float64(source.position[0] - listener.position[0])
+			diffY := float64(source.position[1] - listener.position[1])
+			walls := world.SolidBetween(listener.position, source.position)
+			if float32(math.Hypot(diffX, diffY))+float32(walls)*wallMuffling > radius {
+				continue
+			}
+			heard[listener.id] = append(heard[listener.id], common.Event{
+				common.EventNoise, -1, listener.id, coarse(source.position), radius,
+			})
+		}
+	}
+	return heard
+}
+
+// coarse snaps a position to the middle of its noiseCell, so a noise only
+// gives away roughly where it came from.
+func coarse(position [2]float32) [2]float32 {
+	var snapped [2]float32
+	for i, value := range position {
+		snapped[i] = float32(math.Floor(float64(value+0.5)/noiseCell))*noiseCell + noiseCell/2 - 0.5
+	}
+	return snapped
+}
+
+// Noise is worked out this many ticks apart
+const noiseInterval = common.TickRate / 2
+
+// Moving slower than this fraction of full speed makes no noise, and faster
+// than maxPace is a respawn rather than running
+const quietPace = 0.5
+const maxPace = 2
+
+// Every wall tile between a noise and a listener takes this many tiles off
+// how far it carries
+const wallMuffling = 3
+
+// Heard noises are placed in the middle of a square this many tiles across
+const noiseCell = 3
+
+var visibilityOffsets = [][2]float32{
+	{0, 0}, {-0.45, -0.45}, {0.45, -0.45}, {-0.45, 0.45}, {0.45, 0.45},
+}
+
+// Players are sent while they're within this many tiles of being in sight,
+// so clients with soft shadows have them to fade out across the blurred edge
+// of sight and the half tile fade past the peripheral radius, instead of
+// them popping at the server's hard edge.
+const visibilityMargin = 0.5
+
+const diagonalMargin = visibilityMargin * math.Sqrt2 / 2
+
+var marginOffsets = [][2]float32{
+	{0, 0},
+	{-visibilityMargin, 0}, {visibilityMargin, 0}, {0, -visibilityMargin}, {0, visibilityMargin},
+	{-diagonalMargin, -diagonalMargin}, {diagonalMargin, -diagonalMargin},
+	{-diagonalMargin, diagonalMargin}, {diagonalMargin, diagonalMargin},
 }
 
 var playerIds = make(chan int)
@@ -169,31 +586,61 @@ var playerDelete = make(chan int)
 type playerUpdate struct {
 	id       int
 	position [2]float32
+	facing   [2]float32
+	interact bool
+	sprint   bool
+	time     int64
 }
 
 type Player struct {
 	id             int
 	toSend         chan *common.ServerState
 	position       [2]float32
-	state          PlayerState
+	facing         [2]float32
+	state          common.PlayerState
 	gobIn          *gob.Decoder
 	gobout         *gob.Encoder
 	invincibleTime int
+	tileBacklog    []common.TileChange
+	name           string
+	tags           int
+	// The Time of their last ClientState
+	echo int64
+	// Teammates share sight and can't tag each other
+	team int
+	// In the heist mode, where the loot they carry came from, and how much
+	// they have escaped with
+	carrying [][2]int
+	loot     int
+	// How many times they have been tagged this round
+	tagged int
+	// Where they were the last time noise was worked out
+	noisePosition [2]float32
+	stamina       common.Stamina
+	// The fastest they are allowed to move without sprinting, which lags
+	// behind their speed by up to slowdownGrace ticks
+	allowedSpeed float32
+	slowdown     int
+	// Whether they have sent their first position yet
+	positioned bool
+	// How far they can still move, whether they last asked to sprint, and
+	// how far they have moved since the last tick
+	budget    float32
+	sprint    bool
+	travelled float32
+	// Where to move them back to, ignoring their moves until they do
+	correction *[2]float32
 }
 
-type PlayerState int
-
-const (
-	playerRun PlayerState = iota
-	playerIt
-	playerInvincible
-)
+var speedMap = map[common.PlayerState]float32{
+	common.PlayerRun:        0.1,
+	common.PlayerIt:         0.15,
+	common.PlayerInvincible: 0.3,
+	common.PlayerCaught:     0}
 
-var colorMap = map[PlayerState][3]float32{
-	playerRun:        [3]float32{0.0, 1.0, 0.0},
-	playerIt:         [3]float32{1.0, 0.0, 0.0},
-	playerInvincible: [3]float32{1.0, 1.0, 1.0}}
-var speedMap = map[PlayerState]float32{
-	playerRun:        0.1,
-	playerIt:         0.15,
-	playerInvincible: 0.3}
+// How many tiles players make noise across when moving at full speed
+var noiseMap = map[common.PlayerState]float32{
+	common.PlayerRun:        8,
+	common.PlayerIt:         12,
+	common.PlayerInvincible: 10,
+	common.PlayerCaught:     0}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"testing"
+)
+
+const darkRoom = `
+1111111111111
+1000000000001
+1000000000001
+1000000000001
+1000000000001
+1000000000001
+1000000000001
+1000000000001
+1111111111111
+`
+
+func TestCanSeePlayer(t *testing.T) {
+	world, err := common.ParseMap(darkRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := &Player{position: [2]float32{2, 2}, facing: [2]float32{1, 0}}
+	cases := []struct {
+		name     string
+		target   *Player
+		lamps    [][2]int
+		expected bool
+	}{
+		// In the viewer's sight but outside their light, with only the
+		// target's own light on them
+		{"dark", &Player{position: [2]float32{6, 5}, facing: [2]float32{-1, 0}}, nil, false},
+		{"facing away in the dark", &Player{position: [2]float32{6, 5}, facing: [2]float32{1, 0}}, nil, false},
+		{"lamp", &Player{position: [2]float32{6, 5}, facing: [2]float32{1, 0}}, [][2]int{{7, 5}}, true},
+		{"flashlight", &Player{position: [2]float32{7, 2}, facing: [2]float32{1, 0}}, nil, true},
+		{"behind", &Player{position: [2]float32{1, 6}, facing: [2]float32{1, 0}}, [][2]int{{1, 5}}, false},
+		// Just past the peripheral radius, close enough to fade in
+		{"edge of sight", &Player{position: [2]float32{2, 5.3}, facing: [2]float32{1, 0}}, [][2]int{{2, 6}}, true},
+	}
+	for _, c := range cases {
+		lights := []common.Light{
+			common.PlayerLight(viewer.position, viewer.facing),
+			common.PlayerLight(c.target.position, c.target.facing),
+		}
+		for _, lamp := range c.lamps {
+			lights = append(lights, common.LampLight(lamp[0], lamp[1]))
+		}
+		viewers := []common.Viewer{{viewer.position, viewer.facing}}
+		if seen := canSeePlayer(world, common.DefaultVision, lights, viewers, c.target); seen != c.expected {
+			t.Errorf("%s: saw target %v, expected %v", c.name, seen, c.expected)
+		}
+	}
+}
+
+func movingPlayer() *Player {
+	player := &Player{positioned: true, stamina: common.FullStamina(), allowedSpeed: 0.1}
+	refillBudget(player)
+	return player
+}
+
+// However many updates are sent in a tick, they can only go as far as the
+// tick allows between them.
+func TestMoveBudget(t *testing.T) {
+	player := movingPlayer()
+	for i := 1; i <= 5; i++ {
+		move(player, playerUpdate{position: [2]float32{float32(i) * 0.1, 0}})
+	}
+	// As far as sprinting goes, which fresh players have the stamina for
+	if player.position[0] > 0.1*common.SprintMultiplier*speedTolerance+0.001 {
+		t.Errorf("moved to %v in one tick", player.position)
+	}
+	if player.correction == nil {
+		t.Fatal("not corrected")
+	}
+
+	// Corrected until a move from where they were put back to arrives
+	refillBudget(player)
+	move(player, playerUpdate{position: [2]float32{0.5, 0}})
+	if player.correction == nil {
+		t.Error("correction dropped before catching up")
+	}
+	refillBudget(player)
+	move(player, playerUpdate{position: [2]float32{player.correction[0] + 0.1, 0}})
+	if player.correction != nil {
+		t.Error("still correcting after catching up")
+	}
+}
+
+// Sprinting spends stamina once a tick, and idle updates don't rest it.
+func TestMoveStamina(t *testing.T) {
+	player := movingPlayer()
+	position := [2]float32{}
+	for tick := 0; tick < 10; tick++ {
+		position[0] += 0.1 * common.SprintMultiplier
+		move(player, playerUpdate{position: position, sprint: true})
+		for i := 0; i < 5; i++ {
+			move(player, playerUpdate{position: position, sprint: true})
+		}
+		refillBudget(player)
+	}
+	if player.correction != nil {
+		t.Fatal("corrected while sprinting")
+	}
+	want := common.FullStamina()
+	for tick := 0; tick < 10; tick++ {
+		want.Update(true)
+	}
+	if player.stamina != want {
+		t.Errorf("stamina %v after sprinting 10 ticks, expected %v", player.stamina, want)
+	}
+}
+
+// Going faster than walking spends stamina even without asking to sprint.
+func TestMoveUnaskedSprint(t *testing.T) {
+	player := movingPlayer()
+	move(player, playerUpdate{position: [2]float32{0.15, 0}})
+	refillBudget(player)
+	if player.correction != nil {
+		t.Fatal("corrected")
+	}
+	if player.stamina.Left != common.MaxStamina-1 {
+		t.Errorf("stamina %v, expected a tick spent", player.stamina.Left)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"math"
+	"math/rand"
+)
+
+// Spawns further than this from the nearest threat are all as good as each
+// other
+const spawnSafeDistance = 15
+
+// Each threat that can see a spawn counts against it as much as being this
+// much closer to them
+const spawnExposure = 10
+
+// spawn moves player to the spawn point furthest from and least seen by the
+// players that threaten them, telling them about it. Maps without spawn
+// points, or with all of them walled in, spawn players on any open tile.
+func spawn(world *common.Map, vision common.Vision, players map[int]*Player, player *Player) {
+	threats := spawnThreats(players, player)
+	position, ok := bestSpawn(world, vision, players, threats, world.Spawns)
+	if !ok {
+		position, ok = bestSpawn(world, vision, players, threats, openTiles(world))
+	}
+	if !ok {
+		// Crates fill every open tile, so there is nowhere better to go
+		position = player.position
+	}
+	teleport(player, position)
+}
+
+// bestSpawn returns the best of the open candidates, or false if none are
+// open. Candidates as good as each other are picked between at random.
+func bestSpawn(world *common.Map, vision common.Vision, players map[int]*Player, threats []*Player, candidates [][2]int) ([2]float32, bool) {
+	best := math.Inf(-1)
+	var bestPosition [2]float32
+	for _, i := range rand.Perm(len(candidates)) {
+		candidate := candidates[i]
+		if world.Get(candidate[0], candidate[1]) != common.WallNone {
+			continue
+		}
+		position := [2]float32{float32(candidate[0]), float32(candidate[1])}
+		score := spawnScore(world, vision, threats, position)
+		if occupied(players, candidate[0], candidate[1]) {
+			score -= 2 * spawnSafeDistance
+		}
+		if score > best {
+			best, bestPosition = score, position
+		}
+	}
+	return bestPosition, !math.IsInf(best, -1)
+}
+
+// spawnThreats returns the players on other teams that are it, or all of
+// the players on other teams when none are.
+func spawnThreats(players map[int]*Player, player *Player) []*Player {
+	var threats, others []*Player
+	for _, other := range players {
+		if other == player || other.team == player.team {
+			continue
+		}
+		others = append(others, other)
+		if other.state == common.PlayerIt {
+			threats = append(threats, other)
+		}
+	}
+	if len(threats) == 0 {
+		return others
+	}
+	return threats
+}
+
+// spawnScore rates spawning at position, higher being safer: further from
+// the nearest threat, and out of their sight.
+func spawnScore(world *common.Map, vision common.Vision, threats []*Player, position [2]float32) float64 {
+	nearest := float64(spawnSafeDistance)
+	seen := 0
+	for _, threat := range threats {
+		dist := math.Hypot(float64(threat.position[0]-position[0]), float64(threat.position[1]-position[1]))
+		nearest = math.Min(nearest, dist)
+		if vision.Sees(world, []common.Viewer{{threat.position, threat.facing}}, position) {
+			seen++
+		}
+	}
+	return nearest - float64(seen*spawnExposure)
+}
+
+func openTiles(world *common.Map) [][2]int {
+	tiles := make([][2]int, 0)
+	for y := 0; y < world.Height; y++ {
+		for x := 0; x < world.Width; x++ {
+			if world.Get(x, y) == common.WallNone {
+				tiles = append(tiles, [2]int{x, y})
+			}
+		}
+	}
+	return tiles
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"testing"
+)
+
+// Spawn points in every corner of a room, with a wall hiding the top right
+// one from the middle of the room
+const spawnRoom = `
+111111111111111111111
+1S00000000000001000S1
+100000000000000100001
+100000000000000000001
+100000000000000000001
+1S00000000000000000S1
+111111111111111111111
+`
+
+func TestSpawn(t *testing.T) {
+	world, err := common.ParseMap(spawnRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		it   *Player
+		want [][2]float32
+	}{
+		{"furthest", &Player{team: 1, state: common.PlayerIt, position: [2]float32{3, 3}, facing: [2]float32{0, 1}}, [][2]float32{{19, 1}, {19, 5}}},
+		{"out of sight", &Player{team: 1, state: common.PlayerIt, position: [2]float32{8, 3}, facing: [2]float32{1, 0}}, [][2]float32{{19, 5}}},
+		{"behind", &Player{team: 1, state: common.PlayerIt, position: [2]float32{17, 3}, facing: [2]float32{1, 0}}, [][2]float32{{1, 1}, {1, 5}}},
+	}
+	for _, c := range cases {
+		for i := 0; i < 10; i++ {
+			player := &Player{id: 1}
+			spawn(world, common.DefaultVision, map[int]*Player{2: c.it}, player)
+			if !containsPosition(c.want, player.position) {
+				t.Errorf("%s: spawned at %v, expected one of %v", c.name, player.position, c.want)
+				break
+			}
+			if player.correction == nil || *player.correction != player.position {
+				t.Errorf("%s: not told about spawning at %v", c.name, player.position)
+				break
+			}
+		}
+	}
+}
+
+func containsPosition(positions [][2]float32, position [2]float32) bool {
+	for _, p := range positions {
+		if p == position {
+			return true
+		}
+	}
+	return false
+}
+
+// With no spawn points open, players are spawned on any open tile.
+func TestSpawnWalledIn(t *testing.T) {
+	world, err := common.ParseMap(spawnRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, point := range world.Spawns {
+		world.Set(point[0], point[1], common.WallCrate)
+	}
+	player := &Player{id: 1}
+	spawn(world, common.DefaultVision, map[int]*Player{}, player)
+	if world.Get(int(player.position[0]), int(player.position[1])) != common.WallNone {
+		t.Errorf("spawned inside a wall at %v", player.position)
+	}
+}
+
+// Whoever is it at the start of a round is placed before everyone else, so
+// runners spawn away from them.
+func TestCountdownSpawnsAwayFromIt(t *testing.T) {
+	world, err := common.ParseMap(spawnRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		players := map[int]*Player{1: {id: 1, team: 1}, 2: {id: 2, team: 2}}
+		round := &Round{mode: &Tag{}, vision: common.DefaultVision}
+		round.countdown(world, players)
+		it, runner := players[1], players[2]
+		if runner.state == common.PlayerIt {
+			it, runner = runner, it
+		}
+		if it.state != common.PlayerIt {
+			t.Fatal("nobody is it")
+		}
+		if within(runner.position, [2]int{int(it.position[0]), int(it.position[1])}, 10) {
+			t.Errorf("runner spawned at %v, near it at %v", runner.position, it.position)
+		}
+	}
+}
+
+// Players keep being told where they spawned, with their moves from before
+// ignored, until a move from there arrives.
+func TestSpawnCorrection(t *testing.T) {
+	world, err := common.ParseMap(spawnRoom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := &Player{id: 1, positioned: true, position: [2]float32{10, 3}, allowedSpeed: 0.1, stamina: common.FullStamina()}
+	spawn(world, common.DefaultVision, map[int]*Player{}, player)
+	spawned := player.position
+	for tick := 0; tick < 5; tick++ {
+		refillBudget(player)
+		move(player, playerUpdate{position: [2]float32{10, 3 + float32(tick)*0.1}})
+		if player.correction == nil || *player.correction != spawned || player.position != spawned {
+			t.Fatalf("tick %d: at %v correcting to %v, expected %v", tick, player.position, player.correction, spawned)
+		}
+	}
+	refillBudget(player)
+	move(player, playerUpdate{position: spawned})
+	if player.correction != nil {
+		t.Error("still correcting after moving from the spawn")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"math/rand"
+)
+
+// Tag is the tag mode: whoever is it tags runners they touch, who become it
+// in turn. The most tags when time runs out wins.
+type Tag struct{}
+
+// A round lasts this many ticks
+const tagRoundTime = 2 * 60 * common.TickRate
+
+// Taggers can't be tagged back for this many ticks
+const invincibleTime = 5 * common.TickRate
+
+func (game *Tag) start(world *common.Map, players map[int]*Player) {
+	for _, player := range players {
+		player.state = common.PlayerRun
+	}
+	pickIt(players)
+}
+
+func (game *Tag) join(player *Player) {
+	player.state = common.PlayerRun
+}
+
+func (game *Tag) leave(player *Player) {}
+
+func (game *Tag) tick(world *common.Map, players map[int]*Player, events []common.Event) ([]common.Event, string) {
+	numIt := 0
+	for _, player := range players {
+		if player.state == common.PlayerInvincible {
+			player.invincibleTime -= 1
+			if player.invincibleTime <= 0 {
+				player.state = common.PlayerRun
+			}
+		}
+
+		if player.state == common.PlayerIt {
+			numIt += 1
+			for _, victum := range players {
+				if player.team == victum.team {
+					continue
+				}
+				diffX := player.position[0] - victum.position[0]
+				diffY := player.position[1] - victum.position[1]
+
+				if diffX < 1 && diffX > -1 && diffY > -1 && diffY < 1 {
+					if victum.state == common.PlayerRun {
+						events = append(events, common.Event{
+							common.EventTag, player.id, victum.id, victum.position, 0,
+						})
+						victum.state = common.PlayerIt
+						victum.tagged++
+						player.state = common.PlayerInvincible
+						player.invincibleTime = invincibleTime
+						player.tags++
+					}
+				}
+			}
+		}
+	}
+
+	// Whoever was it may have left
+	if numIt == 0 {
+		pickIt(players)
+	}
+	return events, ""
+}
+
+func (game *Tag) timeUp(players map[int]*Player) string {
+	var best *Player
+	for _, player := range players {
+		if best == nil || player.tags > best.tags || player.tags == best.tags && player.id < best.id {
+			best = player
+		}
+	}
+	if best == nil {
+		return "Nobody wins"
+	}
+	return best.name + " wins!"
+}
+
+func (game *Tag) roundTime() int {
+	return tagRoundTime
+}
+
+func (game *Tag) report(player *Player, state *common.ServerState) {
+	if player.state == common.PlayerInvincible {
+		state.InvincibleTime = player.invincibleTime
+	}
+}
+
+// pickIt makes a random runner it.
+func pickIt(players map[int]*Player) {
+	runners := make([]*Player, 0, len(players))
+	for _, player := range players {
+		if player.state == common.PlayerRun {
+			runners = append(runners, player)
+		}
+	}
+	if len(runners) > 0 {
+		runners[rand.Intn(len(runners))].state = common.PlayerIt
+	}
+}
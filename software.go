@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/Laremere/line-of-sight/common"
+	"github.com/Laremere/line-of-sight/raster"
+	"image"
+)
+
+// SoftwareRenderer renders in pure Go, for when there is no GPU.
+type SoftwareRenderer struct {
+	screenWidth,
+	screenHeight int
+	canvas *raster.Canvas
+	atlas  *raster.Atlas
+	alpha  float32
+	dots   []minimapDot
+	// Everything seen since the walls were generated
+	explored   *raster.Explored
+	minimapFog bool
+}
+
+func NewSoftwareRenderer(screenWidth, screenHeight int) *SoftwareRenderer {
+	return &SoftwareRenderer{screenWidth: screenWidth, screenHeight: screenHeight}
+}
+
+func (sr *SoftwareRenderer) setAtlas(atlas *raster.Atlas) {
+	sr.atlas = atlas
+}
+
+// Walls are drawn straight from the scene, so there is only what has been
+// seen to forget.
+func (sr *SoftwareRenderer) generateWalls(scene *Scene) {
+	sr.explored = raster.NewExplored(scene.world)
+}
+
+func (sr *SoftwareRenderer) draw(scene *Scene, ops *OutputState) {
+	sr.alpha = ops.alpha
+	sr.dots = sr.dots[:0]
+	sr.canvas = raster.NewCanvas(raster.Camera{
+		ops.screenCenter, ops.pixelsPerTile, sr.screenWidth, sr.screenHeight,
+	})
+	sr.canvas.Atlas = sr.atlas
+	sr.canvas.Shadow(scene.world, ops.viewers(), ops.vision)
+	sr.explored.Add(sr.canvas)
+	sr.canvas.Explored = sr.explored
+	sr.canvas.Light(scene.world, ops.lights)
+	sr.canvas.Background()
+	sr.canvas.Walls(scene.world)
+	for _, entity := range scene.entities {
+		entity.draw(sr)
+	}
+	if ops.minimap {
+		sr.drawMinimap(scene.world, ops.screenBounds)
+	}
+	drawHud(sr, ops)
+}
+
+// drawMinimap draws the whole map, dimmed where unexplored if minimapFog is
+// set.
+func (sr *SoftwareRenderer) drawMinimap(m *common.Map, screenBounds [2]float32) {
+	corner, pixelsPerTile := minimapLayout(screenBounds, m.Width, m.Height)
+	left, top := int(corner[0]), int(corner[1])
+	sr.canvas.Rect(left-2, top-2, int(float32(m.Width)*pixelsPerTile)+4, int(float32(m.Height)*pixelsPerTile)+4, [3]float32{0, 0, 0})
+	sr.canvas.Minimap(m, left, top, pixelsPerTile, sr.minimapFog)
+	for _, dot := range sr.dots {
+		position, size := dot.rect(corner, pixelsPerTile, m.Height)
+		sr.canvas.Rect(int(position[0]), int(position[1]), int(size), int(size), dot.color)
+	}
+}
+
+func (sr *SoftwareRenderer) renderImage(scene *Scene, ops *OutputState) *image.RGBA {
+	sr.draw(scene, ops)
+	return sr.canvas.Image
+}
+
+func (sr *SoftwareRenderer) interpolation() float32 {
+	return sr.alpha
+}
+
+func (sr *SoftwareRenderer) sprite(position [2]float32, state common.PlayerState, color [3]float32) {
+	if sr.atlas != nil {
+		sr.canvas.Sprite(position, 1, sr.atlas.Players[state], 1, false)
+		return
+	}
+	sr.canvas.Quad(position, 1, color, 1, false)
+}
+
+func (sr *SoftwareRenderer) ghost(position [2]float32, state common.PlayerState, color [3]float32, alpha float32) {
+	if sr.atlas != nil {
+		sr.canvas.Sprite(position, 0.6, sr.atlas.Players[state], alpha, true)
+		return
+	}
+	sr.canvas.Quad(position, 0.6, color, alpha, true)
+}
+
+func (sr *SoftwareRenderer) text(position [2]float32, text string, color [3]float32) {
+	sr.canvas.Text(int(position[0]), int(position[1]), text, textScale, color)
+}
+
+func (sr *SoftwareRenderer) toScreen(position [2]float32) [2]float32 {
+	x, y := sr.canvas.Camera.Pixel(position)
+	return [2]float32{float32(x), float32(y)}
+}
+
+func (sr *SoftwareRenderer) effect(position, size [2]float32, color [3]float32, alpha float32, ignoreLos bool) {
+	sr.canvas.Box(position, size, color, alpha, ignoreLos)
+}
+
+func (sr *SoftwareRenderer) minimapDot(position [2]float32, color [3]float32) {
+	sr.dots = append(sr.dots, minimapDot{position, color})
+}